@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// readCheckpoint returns the number of input records saved in file, or 0 if
+// it doesn't exist yet.
+func readCheckpoint(file string) (int, error) {
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// writeCheckpoint saves the number of input records analyzed to file. It
+// writes a temporary file and renames it into place so an interrupted write
+// never leaves a truncated checkpoint.
+func writeCheckpoint(file string, records int) error {
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(records)+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
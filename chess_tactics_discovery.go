@@ -4,317 +4,1594 @@
 // Usage:
 //  $ SQLUSER=root SQLPASS=password SQLIP=127.0.0.1 SQLPORT=3306 ./chess_tactics_discovery -engine=stockfish < test.epd
 //
-// reads EPD files from standard in and writes discovered blunders (mates, bad moves) to chess_tactics.positions table
+// reads EPD files (optionally gzipped) named on the command line (or standard in when none are given) and writes discovered blunders (mates, bad moves) to chess_tactics.positions table
 // described below (mysql database is called chess_tactics, and has the following table in it):
 //
 // mysql> desc positions;
-// +---------+---------------+------+-----+---------+----------------+
-// |Field   | Type          | Null | Key | Default | Extra          |
-// +---------+---------------+------+-----+---------+----------------+
-// | id      | bigint(20)    | NO   | PRI | NULL    | auto_increment |
-// | fen     | varchar(1024) | NO   | MUL | NULL    |                |
-// | sm      | varchar(10)   | NO   |     | NULL    |                |
-// | cp      | int(11)       | YES  |     | NULL    |                |
-// | dm      | int(11)       | YES  |     | NULL    |                |
-// | bm      | varchar(10)   | YES  |     | NULL    |                |
-// | blunder | int(11)       | YES  |     | NULL    |                |
-// +---------+---------------+------+-----+---------+----------------+
-// 7 rows in set (0.00 sec)
+// +--------------+---------------+------+-----+---------+----------------+
+// | Field        | Type          | Null | Key | Default | Extra          |
+// +--------------+---------------+------+-----+---------+----------------+
+// | id           | bigint(20)    | NO   | PRI | NULL    | auto_increment |
+// | fen          | varchar(1024) | NO   | UNI | NULL    |                |
+// | sm           | varchar(10)   | NO   |     | NULL    |                |
+// | cp           | int(11)       | YES  |     | NULL    |                |
+// | dm           | int(11)       | YES  |     | NULL    |                |
+// | bm           | varchar(10)   | YES  |     | NULL    |                |
+// | blunder      | int(11)       | YES  |     | NULL    |                |
+// | pv           | varchar(1024) | YES  |     | NULL    |                |
+// | kind         | varchar(20)   | YES  |     | NULL    |                |
+// | depth        | int(11)       | YES  |     | NULL    |                |
+// | nodes        | bigint(20)    | YES  |     | NULL    |                |
+// | move_num     | int(11)       | YES  |     | NULL    |                |
+// | side         | char(1)       | YES  |     | NULL    |                |
+// | difficulty   | int(11)       | YES  |     | NULL    |                |
+// | epd_id       | varchar(255)  | YES  |     | NULL    |                |
+// | engine       | varchar(64)   | YES  |     | NULL    |                |
+// | search_limit | varchar(32)   | YES  |     | NULL    |                |
+// | tactical     | tinyint(1)    | YES  |     | NULL    |                |
+// | tablebase    | tinyint(1)    | YES  |     | NULL    |                |
+// +--------------+---------------+------+-----+---------+----------------+
+// 19 rows in set (0.00 sec)
+//
+// cp and dm are the engine's centipawn and mate-in scores after the played move (sm), from White's point
+// of view: positive values favour White and negative values favour Black.
+//
+// dm is signed the same way, so dm=3 is White mating in 3 and dm=-3 Black mating in 3; it is 0 when
+// the engine reported no mate. Only mates within -max-mate-in moves count as blunders.
+//
+// The blunder column holds the centipawns the played move (sm) lost, or 10000 when it walks into a mate
+// and 20000 when it passes up a forced mate that the best move (bm) plays.
+//
+// Its sign tells how: negative when the mover was ahead before sm and threw the advantage away
+// (blunder=-450 from +200 to -250, or -20000 for a missed mate), positive when the mover was level or
+// already behind and made it worse. -min-blunder compares against the size, ignoring the sign.
+//
+// kind classifies each tactic as mate_allowed, mate_missed, draw_blunder (a winning position drawn, see
+// -draw-band), material_blunder (the best move is at least 300 centipawns better) or positional_blunder;
+// -kinds restricts which kinds are recorded.
+//
+// -prefer=cp builds material puzzle sets from the same corpus: a blunder whose best move is at least 300
+// centipawns better than the played one is a material_blunder even when it also allows or misses a mate,
+// which -prefer=mate, the default, classifies first. A mate counts as 100000 centipawns less the moves to
+// it, so with -prefer=cp a blunder that allows a mate the best move avoids, or misses one, is a
+// material_blunder.
+//
+// Pass -use-wdl to have the engine report win/draw/loss chances (UCI_ShowWDL) and detect blunders by how
+// far they drop the mover's winning chances, a draw counting half: -min-win-drop=30 percentage points by
+// default, in place of -max-cp. Positions the engine reports no chances for fall back to centipawns.
+//
+// A move's score is compared with the score after the mover's previous move, so one badly off evaluation
+// there can hide a blunder or invent one. Pass -baseline=game to search every move of a game first and only
+// then compare each with the median score, from the mover's side, of the three half moves before it, so no
+// single evaluation sets the baseline. Only one game's scores are held at a time.
+//
+// depth is the shallower of the searches of the played and best moves and nodes the total nodes they
+// searched, so low-confidence evaluations can be filtered out.
+//
+// move_num is the fullmove number of the position and side the player to move in it (w or b).
+//
+// difficulty rates from 0 to 100 how hard bm is to find: longer best lines, a quiet bm (no capture or
+// check) and a wide gap to the engine's second choice make it harder. The gap is only known when
+// -multipv is above 1.
+//
+// Pass -forcing-threshold=150 to keep only forced combinations: the best move must beat the engine's second
+// choice by at least that many centipawns (or be the only one that mates), which drops positions with several
+// good replies. It needs two ranked lines, so it raises -multipv to at least 2.
+//
+// engine is the name the engine gave in its id reply and search_limit how long each move was searched
+// (e.g. movetime 1000, depth 25 or nodes 1000000), so rows from different runs can be told apart.
+//
+// Pass -nodes=1000000 to search each move for a fixed number of nodes instead of -movetime: unlike a time
+// limit, which depends on the CPU, or a depth, which some positions reach far sooner than others, a node
+// limit gives the same analysis on any machine with the same engine. Like -depth it takes the place of
+// -movetime, and it cannot be combined with -depth.
+//
+// tactical is set when the best line mates or opens with a capture or check and wins at least two pawns
+// of material within three moves, as opposed to a slow positional edge; -tactical-only records only those.
+//
+// Pass -syzygy-path=/tb/wdl:/tb/dtz to have the engine consult Syzygy tablebases (its SyzygyPath option),
+// so endgames the tablebases call drawn aren't reported from a short search that thinks they're won.
+// tablebase is set on rows whose played or best move search hit the tablebases.
+//
+// sm and bm are in UCI notation (e.g. g1f3) unless -notation=san is given, which stores them in SAN
+// (e.g. Nf3) instead; pv is always UCI.
+//
+// pv is the engine's best line from the position, cut to its first -pv-length=6 moves by default so a
+// puzzle's solution doesn't trail off into the rest of the game; -pv-length=0 stores the whole line.
+//
+// To try it without a MySQL server, pass -db=sqlite to write to a local chess_tactics.db file (see
+// -sqlite-file), where the positions table is created automatically with a unique index on fen, so a
+// position already stored is counted as a duplicate rather than stored again.
+//
+// Pass -db=postgres to use PostgreSQL instead; the connection is built from the same SQLUSER, SQLPASS,
+// SQLIP and SQLPORT variables (or -dsn) and the positions table is created if it doesn't exist.
+//
+// -table and -database choose the table tactics are stored in and, when no -dsn is given, the database
+// to connect to, e.g. -table=positions_lichess to keep each source separate.
+//
+// Pass -input=db to read games from a table of (move_num, fen, move) rows in the -db database instead of
+// from files, -source-table=games by default. Rows are read in the order the database returns them, or in
+// order of the -source-order column, e.g. -source-order=id, and grouped into games the same way as
+// db-extract's records. The source is only read; opening it creates no -table in it. -checkpoint needs
+// -source-order with -input=db, as resuming skips the rows already read and only a fixed order makes them
+// the same rows.
+//
+// Records with a malformed FEN, or whose played move isn't legal in it, are skipped and counted in the end
+// of run summary rather than scored: the engine would otherwise ignore the illegal searchmoves and score its
+// own best move. Legality isn't checked with -chess960 or -variant, leaving those moves to the engine.
+//
+// Every FEN is tidied before it is checked and sent to the engine: stray whitespace is collapsed, and a
+// halfmove clock or fullmove number that is missing, malformed or impossible (over 150, past the
+// seventy-five move rule, or over 10000) becomes 0 or 1, so the engine doesn't misread its position fen
+// command and analyze a different position. A clock of 100 to 150 is kept as it is, and the engine scores
+// those positions as drawn by the fifty-move rule.
+//
+// Pass -skip-analyzed when running over overlapping inputs: every position analyzed is recorded in a
+// positions_analyzed table (named after -table) and positions already in it are skipped.
+//
+// Pass -output=json to skip the database entirely and write each tactic to standard out as a line of JSON.
+//
+// Pass -output=pgn to write each tactic to standard out as a PGN game instead, set up from its FEN with
+// the best line as its moves, ready to load into a chess GUI.
+//
+// Pass -output=csv for a spreadsheet friendly export: a header row naming the table's columns, then a line
+// per tactic with the same fields. -out=tactics.csv writes the -output=json, csv or pgn to a file instead of
+// standard out.
+//
+// Pass -count-only to survey a corpus without storing anything: no database is opened and nothing is
+// written to standard out, the end of run summary just counts the tactics found of each kind.
+//
+// Pass -serve=:8080 to keep the engines running and answer queries instead of reading input: POST
+// {"fen": "...", "move": "g1f3"} to /analyze to get back the cp and mate score of the move (or of the
+// best move when none is given) with the engine's bestmove and pv as JSON, and its kind when it is a
+// blunder, judged against the best move's score as games are judged against the previous move's, that
+// falls -min-advantage short of the best move, or when it passes up a mate.
+//
+// /metrics, served alongside /analyze, or on its own address during a run with -metrics=:9090, reports in
+// the Prometheus text format the positions analyzed, the tactics found by kind, the engine restarts and the
+// positions that could not be analyzed, along with a histogram of the time each position took
+// (ctd_position_analysis_seconds). A run's counts are added as each game finishes.
+//
+// Pass -reanalyze to search the tactics already stored in -table again, e.g. at a greater -depth, instead
+// of reading input: rows whose best move still beats the played one have their scores updated and the
+// rest are deleted.
+//
+// Pass -chess960 to analyze Fischer Random games: the engine is told to expect them with UCI_Chess960
+// and Shredder-FEN castling rights such as HAha are accepted.
+//
+// Pass -variant to analyze games of a variant the engine supports, e.g. -variant=atomic with Fairy-Stockfish:
+// it sets UCI_Variant, and FENs are only checked for a side to move since variant boards may hold pieces in
+// hand, lack a king or carry extra fields.
+//
+// -workers runs that many engines in parallel and -threads sets each one's Threads option, so -workers=4
+// -threads=2 fills 8 cores with four engines searching two threads each.
+//
+// -verify-engine=/path/to/lc0 cuts down on false positives: each tactic the main engine finds is searched again by
+// that second engine, under the same limits and options, and only recorded if it too finds the best move beats
+// the played one by -min-advantage. Each worker runs one of each engine.
+//
+// Pass -engine-protocol=cecp to analyze with an xboard/WinBoard engine instead of a UCI one. It must
+// support protover 2 with the setboard and ping features, and not turn off analyze. Of the features it
+// offers, only setboard, ping, usermove, myname, memory, smp, egt, option and done are accepted; the
+// rest, san among them, are rejected. Searches run in analyze mode and end with exit once -movetime,
+// -depth or -nodes is reached. CECP has no searchmoves, so the played move is scored by analyzing the
+// position after it. The engine's thinking output is read for the score, with mates counted from 100000,
+// and its line is converted from SAN to UCI. -hash, -threads and -syzygy-path map to their CECP commands,
+// and other options are set only when the engine offers them. CECP engines report a single line, so
+// -multipv, -forcing-threshold and -single-search are refused with them, as are -chess960 and -variant,
+// whose moves couldn't be converted. -verify-engine always speaks UCI.
+//
+// -min-moves=12, the default, skips each game's opening up to move 12, where book moves rarely make tactics.
+// -skip-plies counts the cut-off in half moves instead and replaces -min-moves when given, so -skip-plies=9
+// starts with Black's fifth move; -max-plies ends each game's analysis after that many half moves. Together
+// they bound the analysis, e.g. -skip-plies=38 -max-plies=80 analyzes moves 20 to 40 only.
+//
+// -last-plies=20 analyzes only the final 20 half moves of each game, where endgame tactics and time trouble
+// blunders cluster; -min-moves still applies, so short games are skipped entirely.
+//
+// -seed=42 shuffles the input games before analysis, reading all of it first, so a fixed -seed and -limit
+// pick the same puzzles from a corpus every run; with -limit, tactics are always recorded in game order
+// whatever order the -workers finish in.
+//
+// Each engine runs a discarded 2 second search of the starting position when it starts, so the first
+// positions aren't searched with a cold hash table; -no-warmup skips it.
+//
+// Pass -config=profile.toml to read flag values from a TOML file, keyed by flag name (movetime = 500,
+// db = "sqlite"); flags given on the command line take precedence over the file.
+//
+// Every flag can also be set from the environment, as CTD_ and its name in upper case with dashes as
+// underscores (CTD_MOVETIME=500, CTD_MAX_CP=250, CTD_WORKERS=4), for containers configured without
+// arguments. The command line takes precedence over the environment, and both over -config; the SQL*
+// variables still fill in the database connection.
+//
+// The engine handling and blunder detection live in the importable github.com/atinm/chess_tactics_discovery/tactics
+// package, for use outside this program: tactics.Engine starts a UCI or CECP engine and searches positions with Eval,
+// and tactics.DetectBlunder and tactics.Classify judge the scores it returns.
+//
+// Log records go to standard error, filtered by -log-level (debug, info, warn or error) and written as
+// text or, with -log-format=json, as JSON lines. The progress line and end of run summary are written to
+// standard error as well, leaving standard out for -output=json, -output=csv and -output=pgn.
+//
+// Pass -dump-eval when a corpus turns up no tactics, to check the scores behind the threshold math: every
+// position analyzed writes a line to standard error with its FEN, the played move's cp and dm, the best move
+// and its scores when it was searched, and the blunder found, all from the mover's side.
+//
+// A search that ends with a bestmove but no score, as a very short -movetime can with some engines, is run
+// again once at twice the movetime; a position still left unscored is skipped rather than taken as a level
+// 0.00, and the skips are counted in the summary.
 //
 // You will need pgn-extract (http://github.com/atinm/pgn-extract and the db-extract program included here to run:
 //
 // $ ~/src/pgn-extract/pgn-extract -Wepd -C -N -V -w5000 --nomovenumbers --nochecks --noresults --notags -s ~/src/chess/db/1.pgn | ~/src/pgn-extract/db-extract | SQLUSER=sqluser SQLPASS=sqlpass SQLIP=127.0.0.1 SQLPORT=3306 ~/gouser/bin/chess_tactics_discovery -engine ~/src/Stockfish/src/stockfish
 //
+// Alternatively, pass -format=pgn to read PGN games directly, without pgn-extract and db-extract:
+//
+// $ ~/gouser/bin/chess_tactics_discovery -engine ~/src/Stockfish/src/stockfish -format=pgn ~/src/chess/db/1.pgn
+//
+// With -format=pgn, -since and -until skip games whose Date tag falls outside the given days
+// (-since=2024-01-01 -until=2024-01-31); games without a full date are skipped too.
+//
+// PGN input is read a game at a time, so monthly Lichess dumps of tens of gigabytes (gzipped or not) stream
+// through in bounded memory; only -seed holds every game back. A game that fails to parse is skipped.
+//
+// Pass -format=epd to read EPD records carrying an sm operation for the move played, one position a line
+// (1k1r4/pp1b1R2/3q2pp/4p3/2B5/4Q3/PPP2B2/2K5 b - - sm Qe7; bm Qd1+; id "BK.01"; fmvn 27;).
+// Their id is stored in the epd_id column, and their bm moves are checked against the engine's best move,
+// with the end of run summary counting how often they agreed. Records with a bm but no sm, as in bm/id test
+// suites, are only searched for that check; pass -min-moves=0 when they have no fmvn.
+//
 package main
 
 import (
-	"bufio"
+	"context"
 	"database/sql"
-	"encoding/csv"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math/rand"
 	"os"
-	"os/exec"
-	"regexp"
+	"os/signal"
+	"runtime"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
-	_ "github.com/go-sql-driver/mysql"
+	"sync"
+	"syscall"
+	"time"
+	"github.com/atinm/chess_tactics_discovery/tactics"
 )
 
 const (
 	MIN_CENTIPAWNS = 300
 	BLUNDER_CENTIPAWNS = 300
 	MAX_MATE_IN = 5
-	MOVE_TIME = "1000"
 	MAX_DEPTH = "25"
 	MIN_MOVES = 12
 )
 
-var EngineReader *bufio.Scanner
-var EngineIn io.Writer
+const (
+	// SINGLE_SEARCH_MULTIPV is the fewest lines searched with -single-search,
+	// so the played move is likely to be among them.
+	SINGLE_SEARCH_MULTIPV = 5
+	// PV_LENGTH is the default -pv-length, enough for most combinations.
+	PV_LENGTH = 6
+)
 
-func send(cmd string, args ...string) (string, string, error) {
-	ok := "ok"
-	secondary := ""
-	
-	switch cmd {
-	case "uci":
-		command := cmd + "\n"
-		//log.Print("cmd: ", command)
-		_, err := io.WriteString(EngineIn, command)
-		if err != nil {
-			log.Fatal("Writing %s to engine: %s", command, err.Error())
+// BASELINE_MOVE and BASELINE_GAME are the Settings.Baseline choices.
+const BASELINE_MOVE = "move"
+const BASELINE_GAME = "game"
+
+// BASELINE_PLIES is how many half moves before a move the median score of
+// BASELINE_GAME is taken over: the mover's previous move, the one before it
+// and the reply in between.
+const BASELINE_PLIES = 3
+
+// difficulty rates from 0 to 100 how hard the best move of the position fen
+// is to find, from the engine's ranked lines: longer winning lines, a quiet
+// key move (no capture or check) and no second move that does nearly as well
+// all make it harder. The gap to the second move is only known with MultiPV.
+func difficulty(fen string, lines []tactics.EngineInfo) int {
+	d := 0
+	plies := len(lines[0].Pv)
+	if plies > 10 {
+		plies = 10
+	}
+	d += plies * 4
+	if san, err := toSAN(fen, lines[0].Move); err == nil {
+		if !strings.ContainsAny(san, "x+#") {
+			d += 30
+		} else if !strings.ContainsAny(san, "+#") {
+			d += 10
 		}
-		
-		// read until we see "uciok"
-		for EngineReader.Scan() {
-			//log.Println(EngineReader.Text())
-			if EngineReader.Text() == "uciok" {
-				break
+	}
+	if len(lines) > 1 {
+		gap := secondGap(lines)
+		if gap >= tactics.MATERIAL_CENTIPAWNS {
+			d += 30
+		} else if gap >= tactics.MATERIAL_CENTIPAWNS/3 {
+			d += 15
+		}
+	}
+	if d > 100 {
+		d = 100
+	}
+	return d
+}
+
+// secondGap returns how many centipawns the engine's best line, of at least
+// two ranked lines, beats its second choice by, counting a mate only the
+// best line finds as MATE_BLUNDER.
+func secondGap(lines []tactics.EngineInfo) int {
+	if lines[0].Mate > 0 && lines[1].Mate <= 0 {
+		return tactics.MATE_BLUNDER
+	}
+	return lines[0].Cp - lines[1].Cp
+}
+
+// forced reports whether the best of the engine's ranked lines beats the
+// second by at least threshold, as the one move of a real combination does.
+// A position with a single legal move is forced.
+func forced(lines []tactics.EngineInfo, threshold int) bool {
+	return threshold <= 0 || len(lines) < 2 || secondGap(lines) >= threshold
+}
+
+// storedPv returns the first length moves of pv, all of it when length is 0,
+// space separated as stored.
+func storedPv(pv []string, length int) string {
+	if length > 0 && len(pv) > length {
+		pv = pv[:length]
+	}
+	return strings.Join(pv, " ")
+}
+
+// kindNames lists the Kind names separated by commas.
+func kindNames() string {
+	names := []string{}
+	for _, kind := range tactics.KINDS {
+		names = append(names, string(kind))
+	}
+	return strings.Join(names, ",")
+}
+
+// parseKinds parses a comma separated list of Kind names into a set.
+func parseKinds(list string) (map[tactics.Kind]bool, error) {
+	kinds := map[tactics.Kind]bool{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		known := false
+		for _, kind := range tactics.KINDS {
+			if tactics.Kind(name) == kind {
+				known = true
 			}
 		}
-		
-	case "position":
-		command := "position fen " + args[0] + "\n"
-		//log.Print("cmd: ", command)
-		_, err := io.WriteString(EngineIn, command)
-		if err != nil {
-			log.Fatal("Writing %s to engine: %s", command, err.Error())
+		if !known {
+			return nil, errors.New("Unrecognized kind: " + name)
+		}
+		kinds[tactics.Kind(name)] = true
+	}
+	return kinds, nil
+}
+
+// searchLimit returns the "go" arguments limiting each search: a fixed depth
+// when depth is set, a node count when nodes is, otherwise movetime in
+// milliseconds, falling back to a depth of MAX_DEPTH when movetime is 0.
+func searchLimit(movetime int, depth int, nodes int64) []string {
+	if depth > 0 {
+		return []string{"depth", strconv.Itoa(depth)}
+	}
+	if nodes > 0 {
+		return []string{"nodes", strconv.FormatInt(nodes, 10)}
+	}
+	if movetime > 0 {
+		return []string{"movetime", strconv.Itoa(movetime)}
+	}
+	return []string{"depth", MAX_DEPTH}
+}
+
+// Settings controls how analyzeGame searches and which moves it reports.
+type Settings struct {
+	// Limit is the "go" arguments bounding each search.
+	Limit []string
+	// Thresholds decide which drops in evaluation are blunders.
+	tactics.Thresholds
+	// MinBlunder is the smallest blunder recorded, letting small drops be
+	// analyzed without being stored.
+	MinBlunder int
+	// MinAdvantage is how many centipawns better than the played move the
+	// best move must be for the position to be a tactic.
+	MinAdvantage int
+	// MinMoves is the first move number analyzed in each game.
+	MinMoves int
+	// SkipPlies and MaxPlies bound the half moves analyzed in each game: the
+	// first SkipPlies are skipped and analysis ends at MaxPlies (0 for no end).
+	// main clears MinMoves when SkipPlies is set, so it replaces it.
+	SkipPlies int
+	MaxPlies  int
+	// LastPlies, if set, restricts analysis to the final LastPlies half
+	// moves of each game.
+	LastPlies int
+	// TacticalOnly records only the tactics whose best line is tactical.
+	TacticalOnly bool
+	// Baseline is what each move's score is compared with: BASELINE_MOVE, the
+	// score after the mover's previous move, or BASELINE_GAME, the median of
+	// the BASELINE_PLIES half moves before it, judged once the whole game has
+	// been searched.
+	Baseline string
+	// ForcingThreshold is how many centipawns the best move must beat the
+	// second best by, or 0 to record tactics with several good replies.
+	ForcingThreshold int
+	// Engine names the engine, as stored with each tactic.
+	Engine string
+	// Analyzed, if set, holds the positions (the first four FEN fields)
+	// analyzed by earlier runs, which are skipped.
+	Analyzed map[string]bool
+	// KeepHash shares the engine's hash table across games instead of
+	// clearing it with ucinewgame.
+	KeepHash bool
+	// Chess960 accepts Shredder-FEN castling rights when validating FENs.
+	Chess960 bool
+	// Variant is the engine's UCI_Variant, e.g. atomic, or empty for
+	// standard chess. FENs of variants are only loosely validated.
+	Variant string
+	// SingleSearch reads the played move's score from the lines of the
+	// unrestricted best move search when it is among them, saving a search.
+	SingleSearch bool
+	// Notation is how the played and best moves are stored: uci or san.
+	Notation string
+	// PvLength is the most moves of the best line stored, 0 for all of them.
+	PvLength int
+	// DumpEval, if set, receives a line with the scores of every position
+	// analyzed.
+	DumpEval io.Writer
+	// Kinds restricts the tactics reported to these kinds; empty reports all.
+	Kinds map[tactics.Kind]bool
+}
+
+// Tactic is a discovered blunder, stored as one row of the positions table.
+type Tactic struct {
+	Fen         string       `json:"fen"`
+	Sm          string       `json:"sm"`
+	Cp          int          `json:"cp"`
+	Dm          int          `json:"dm"`
+	Bm          string       `json:"bm"`
+	Blunder     int          `json:"blunder"`
+	// Pv is the engine's best line from the position, space separated.
+	Pv          string       `json:"pv"`
+	Kind        tactics.Kind `json:"kind"`
+	// Depth is the shallower of the played and best move searches, and
+	// Nodes the total searched by both.
+	Depth       int          `json:"depth"`
+	Nodes       int64        `json:"nodes"`
+	// MoveNum is the fullmove number of the position and Side the player to
+	// move in it, "w" or "b".
+	MoveNum     int          `json:"move_num"`
+	Side        string       `json:"side"`
+	// Difficulty rates how hard the best move is to find, from 0 to 100.
+	Difficulty  int          `json:"difficulty"`
+	// EpdId is the id operation of the EPD record, if any.
+	EpdId       string       `json:"epd_id"`
+	// Engine is the engine's name and SearchLimit how long it searched each
+	// move, e.g. "movetime 1000".
+	Engine      string       `json:"engine"`
+	SearchLimit string       `json:"search_limit"`
+	// Tactical is set when the best line mates or starts with a capture or
+	// check that soon wins material, as opposed to a slow positional edge.
+	Tactical    bool         `json:"tactical"`
+	// Tablebase is set when either search hit the engine's tablebases.
+	Tablebase   bool         `json:"tablebase"`
+}
+
+// stringList is a flag.Value collecting each use of a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// sideToMove returns "w" or "b" from the active color field of fen.
+func sideToMove(fen string) string {
+	fields := strings.Fields(fen)
+	if len(fields) > 1 && fields[1] == "b" {
+		return "b"
+	}
+	return "w"
+}
+
+// Analyzer is the part of tactics.Engine that analyzeGame uses, so games can be
+// analyzed by something other than a UCI subprocess.
+type Analyzer interface {
+	Eval(ctx context.Context, fen string, moves []string, limit []string) (string, []tactics.EngineInfo, error)
+	NewGame(ctx context.Context) error
+	Restart() error
+}
+
+// analyzeGame evaluates each move of game from settings.MinMoves on, returning
+// the blunders found. With verify, each one is only kept if that second
+// engine agrees it holds up. It gives up part way through the game, marking
+// the result Interrupted, once ctx is done.
+func analyzeGame(ctx context.Context, e Analyzer, verify Analyzer, game Game, settings Settings) Result {
+	res := Result{Game: game}
+	if !settings.KeepHash {
+		if err := e.NewGame(ctx); err != nil {
+			if ctx.Err() != nil {
+				res.Interrupted = true
+				return res
+			}
+			// a fresh engine starts with an empty hash anyway
+			if err := e.Restart(); err != nil {
+				fatal(err.Error())
+			}
+		}
+	}
+
+	// last score of each side's moves, keyed by side to move
+	prevs := map[string]tactics.EngineInfo{}
+	// mate score of the previous move, from the side that played it
+	prevdm, prevside := 0, ""
+	// positions already analyzed in this game, ignoring the move counters
+	occurred := map[string]bool{}
+	// the whole game is at hand, so its length is known up front
+	firstPly := 0
+	if settings.LastPlies > 0 && len(game.Records) > 0 {
+		firstPly = plyOf(game.Records[len(game.Records)-1]) + 1 - settings.LastPlies
+	}
+	// the scores of the moves judged since the last reset, in order
+	recent := []scored{}
+	// searchBest searches fen for the best move, returning nil lines when the
+	// position is to be skipped and false once ctx is done
+	searchBest := func(fen string) (string, []tactics.EngineInfo, bool) {
+		bm, lines, err := e.Eval(ctx, fen, nil, settings.Limit)
+		if err == tactics.ErrNoMove {
+			slog.Info("skipping position", "fen", fen, "err", err)
+			return "", nil, true
+		}
+		if err == tactics.ErrNoScore {
+			slog.Warn("skipping position", "fen", fen, "err", err)
+			res.NoScore += 1
+			return "", nil, true
+		}
+		if ctx.Err() != nil {
+			res.Interrupted = true
+			return "", nil, false
 		}
-		
-	case "go":		
-		command := "go"
-		for _, arg := range args {
-			command = command + " " + arg
-		}
-		command += "\n"
-		//log.Print("cmd: ", command)
-		_, err := io.WriteString(EngineIn, command)
 		if err != nil {
-			log.Fatal("Writing %s to engine: %s", command, err.Error())
+			fatal("analyzing", "fen", fen, "err", err)
+		}
+		res.count(lines[0])
+		return bm, lines, true
+	}
+	// judge looks for a blunder in ev, the next move evaluated, returning
+	// false once ctx is done
+	judge := func(ev evaluated) bool {
+		fen, sm, side := ev.fen, ev.sm, ev.side
+		if ev.known {
+			// the next move of this side has nothing to compare against
+			delete(prevs, side)
+			prevside = ""
+			recent = nil
+			return true
+		}
+		defer func(start time.Time) {
+			res.Times = append(res.Times, ev.took+time.Since(start))
+		}(time.Now())
+		smlines, best, bestlines := ev.smlines, ev.best, ev.bestlines
+		move_num, expected, id := ev.moveNum, ev.expected, ev.id
+		if expected != "" {
+			// the EPD bm is checked whatever becomes of the played move
+			if bestlines == nil {
+				var ok bool
+				best, bestlines, ok = searchBest(fen)
+				if !ok {
+					return false
+				}
+				if bestlines == nil {
+					return true
+				}
+			}
+			res.Annotated += 1
+			if slices.Contains(strings.Fields(expected), best) {
+				res.Agreed += 1
+			} else {
+				slog.Info("engine disagrees with the EPD bm", "fen", fen, "bm", best, "epd_bm", expected)
+			}
+		}
+		if sm == "" {
+			// a test position without a played move, which breaks the
+			// comparison with this side's previous move
+			delete(prevs, side)
+			prevside = ""
+			recent = nil
+			return true
 		}
+		smcp, smdm := smlines[0].Cp, smlines[0].Mate
+		blunder := 0
+
+		// the previous move allowed a mate, see whether sm found it; only
+		// when that move was the opponent's
+		oppdm := 0
+		if prevside != "" && prevside != side {
+			oppdm = prevdm
+		}
+		prevdm, prevside = smdm, side
 
-		// read until we see "bestmove"
-		for EngineReader.Scan() {
-			//log.Println(EngineReader.Text())
-			if strings.HasPrefix(EngineReader.Text(), "bestmove") {
-				rebm := regexp.MustCompile("bestmove ([a-z0-9]+)")
-				bmarr := rebm.FindStringSubmatch(EngineReader.Text())
-				if len(bmarr) > 1 {
-					ok = bmarr[1]
+		prev, seen := prevs[side]
+		prevs[side] = smlines[0]
+		window := recent
+		if len(window) > BASELINE_PLIES {
+			window = window[len(window)-BASELINE_PLIES:]
+		}
+		recent = append(recent, scored{side: side, info: smlines[0]})
+		if !seen {
+			// first move for this side, nothing to compare against
+			dumpEval(settings.DumpEval, fen, sm, smlines[0], best, bestlines, 0)
+			return true
+		}
+		if settings.Baseline == BASELINE_GAME && len(window) > 0 {
+			prev = baseline(window, side)
+		}
+		blunder = tactics.DetectBlunder(prev, smlines[0], settings.Thresholds)
+
+		mateMissable := blunder == 0 && smdm <= 0 && tactics.MatedIn(oppdm, settings.MaxMateIn)
+		if blunder == 0 && !mateMissable {
+			dumpEval(settings.DumpEval, fen, sm, smlines[0], best, bestlines, 0)
+		}
+
+		if blunder > 0 || mateMissable {
+			bm, bmlines := best, bestlines
+			if bmlines == nil {
+				// run evaluation for best move
+				var ok bool
+				bm, bmlines, ok = searchBest(fen)
+				if !ok {
+					return false
+				}
+				if bmlines == nil {
+					return true
 				}
-				break
 			}
-			if strings.HasPrefix(EngineReader.Text(), "info") {
-				secondary = EngineReader.Text()
+			dumpEval(settings.DumpEval, fen, sm, smlines[0], bm, bmlines, blunder)
+			bmcp, bmdm := bmlines[0].Cp, bmlines[0].Mate
+			pv := storedPv(bmlines[0].Pv, settings.PvLength)
+
+			found := false
+			if mateMissable {
+				found = bm != sm && tactics.MatesIn(bmdm, settings.MaxMateIn)
+				blunder = tactics.MISSED_MATE_BLUNDER
+			} else {
+				found = bm != sm && ((bmcp - smcp >= settings.MinAdvantage) || tactics.MatesIn(bmdm, settings.MaxMateIn))
 			}
+			kind := tactics.Classify(smcp, smdm, bmcp, bmdm, settings.Thresholds)
+			tactical := tactics.MatesIn(bmdm, settings.MaxMateIn) || tacticalLine(fen, bmlines[0].Pv)
+			if found && blunder >= settings.MinBlunder && (len(settings.Kinds) == 0 || settings.Kinds[kind]) &&
+				(tactical || !settings.TacticalOnly) && forced(bmlines, settings.ForcingThreshold) {
+				if verify != nil {
+					check := reanalyzeTactic(ctx, verify, storedTactic{fen: fen, sm: sm}, settings)
+					if ctx.Err() != nil {
+						res.Interrupted = true
+						return false
+					}
+					if check.err != nil {
+						fatal("verifying", "fen", fen, "err", check.err)
+					}
+					if !check.keep {
+						slog.Info("verify engine disagrees", "fen", fen, "sm", sm, "bm", bm)
+						res.Unverified += 1
+						return true
+					}
+				}
+				// engine scores are from the mover's side, store them from White's
+				sign := 1
+				if side == "b" {
+					sign = -1
+				}
+				depth := smlines[0].Depth
+				if bmlines[0].Depth < depth {
+					depth = bmlines[0].Depth
+				}
+				nodes := smlines[0].Nodes + bmlines[0].Nodes
+				if prev.Cp > 0 || prev.Mate > 0 || mateMissable {
+					// the mover was ahead and threw it away
+					blunder = -blunder
+				}
+				smout, bmout := sm, bm
+				if settings.Notation == "san" {
+					smout, bmout = sanOrUCI(fen, sm), sanOrUCI(fen, bm)
+				}
+				res.Tactics = append(res.Tactics, Tactic{
+					Fen:         fen,
+					Sm:          smout,
+					Cp:          sign * smcp,
+					Dm:          sign * smdm,
+					Bm:          bmout,
+					Blunder:     blunder,
+					Pv:          pv,
+					Kind:        kind,
+					Depth:       depth,
+					Nodes:       nodes,
+					MoveNum:     move_num,
+					Side:        side,
+					Difficulty:  difficulty(fen, bmlines),
+					EpdId:       id,
+					Engine:      settings.Engine,
+					SearchLimit: strings.Join(settings.Limit, " "),
+					Tactical:    tactical,
+					Tablebase:   smlines[0].Tbhits > 0 || bmlines[0].Tbhits > 0,
+				})
+			}
+		}
+		return true
+	}
+
+	// judged passes ev to judge, unless settings.Baseline is BASELINE_GAME,
+	// when it is kept to be judged once all the game's moves are evaluated
+	evals := []evaluated{}
+	judged := func(ev evaluated) bool {
+		if settings.Baseline == BASELINE_GAME {
+			evals = append(evals, ev)
+			return true
+		}
+		return judge(ev)
+	}
+	for _, record := range game.Records {
+		move_num, _ := strconv.Atoi(record[0])
+		if move_num < settings.MinMoves {
+			continue
+		}
+		ply := plyOf(record)
+		if ply < settings.SkipPlies || ply < firstPly {
+			continue
+		}
+		if settings.MaxPlies > 0 && ply >= settings.MaxPlies {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			res.Interrupted = true
+			return res
+		default:
 		}
 		
-	default:
-		return "error", "", errors.New("Unrecognized cmd: " + cmd)
+		// missing or malformed move counters become 0 1 rather than invalid
+		fen := tactics.NormalizeFEN(record[1])
+		sm := record[2]
+		// EPD input carries the best moves it expects, if any, and an id
+		expected, id := "", ""
+		if len(record) > 4 {
+			expected, id = record[3], record[4]
+		}
+
+		if err := checkFEN(fen, settings); err != nil {
+			slog.Warn("skipping invalid FEN", "fen", fen, "err", err)
+			res.Invalid += 1
+			continue
+		}
+		// searchmoves ignores an illegal move, scoring the best one instead;
+		// the board model knows neither Chess960 castling nor variants
+		if sm != "" && !settings.Chess960 && settings.Variant == "" && !legalMove(fen, sm) {
+			slog.Warn("skipping illegal played move", "fen", fen, "sm", sm)
+			res.Illegal += 1
+			continue
+		}
+		side := sideToMove(fen)
+		position := strings.Join(strings.Fields(fen)[:4], " ")
+		if occurred[position] {
+			// shuffling back to a position already analyzed
+			res.Repetitions += 1
+			continue
+		}
+		occurred[position] = true
+		if settings.Analyzed[position] {
+			// analyzed by an earlier run; the next move of this side has
+			// nothing to compare against
+			res.Known += 1
+			if !judged(evaluated{side: side, known: true}) {
+				return res
+			}
+			continue
+		}
+		if sm == "" {
+			// an EPD test position, only searched for its bm
+			res.Positions += 1
+			if settings.Analyzed != nil {
+				res.Analyzed = append(res.Analyzed, position)
+			}
+			if !judged(evaluated{fen: fen, side: side, moveNum: move_num, expected: expected, id: id}) {
+				return res
+			}
+			continue
+		}
+		
+		start := time.Now()
+		// with settings.SingleSearch, look for sm among the lines of an
+		// unrestricted search, which are kept for the best move too
+		var best string
+		var bestlines, smlines []tactics.EngineInfo
+		if settings.SingleSearch {
+			bm, lines, err := e.Eval(ctx, fen, nil, settings.Limit)
+			if err == tactics.ErrNoMove {
+				slog.Info("skipping position", "fen", fen, "err", err)
+				continue
+			}
+			if err == tactics.ErrNoScore {
+				slog.Warn("skipping position", "fen", fen, "err", err)
+				res.NoScore += 1
+				continue
+			}
+			if ctx.Err() != nil {
+				res.Interrupted = true
+				return res
+			}
+			if err != nil {
+				fatal("analyzing", "fen", fen, "err", err)
+			}
+			res.count(lines[0])
+			best, bestlines = bm, lines
+			for i := range lines {
+				if lines[i].Move == sm {
+					smlines = lines[i : i+1]
+					break
+				}
+			}
+		}
+		if smlines == nil {
+			// run evaluation of sm
+			_, lines, err := e.Eval(ctx, fen, []string{sm}, settings.Limit)
+			if err == tactics.ErrNoMove {
+				slog.Info("skipping position", "fen", fen, "err", err)
+				continue
+			}
+			if err == tactics.ErrNoScore {
+				slog.Warn("skipping position", "fen", fen, "err", err)
+				res.NoScore += 1
+				continue
+			}
+			if ctx.Err() != nil {
+				res.Interrupted = true
+				return res
+			}
+			if err != nil {
+				fatal("analyzing", "fen", fen, "err", err)
+			}
+			res.count(lines[0])
+			smlines = lines
+		}
+		if smlines[0].Mated {
+			// "mate 0", the game is already over
+			slog.Info("skipping checkmated position", "fen", fen)
+			continue
+		}
+		res.Positions += 1
+		if settings.Analyzed != nil {
+			res.Analyzed = append(res.Analyzed, position)
+		}
+		ev := evaluated{fen: fen, sm: sm, side: side, moveNum: move_num, expected: expected, id: id, smlines: smlines, best: best, bestlines: bestlines, took: time.Since(start)}
+		if !judged(ev) {
+			return res
+		}
 	}
-	
-	if err := EngineReader.Err(); err != nil {
-		log.Fatal("Reading engine output: ", err)
-		return err.Error(), "", err
+	// with the whole game's scores in, judge each move
+	for _, ev := range evals {
+		if !judge(ev) {
+			return res
+		}
 	}
-	return ok, secondary, nil
+	return res
 }
 
-func eval(fen string, move string) (string, int, int, error) {
-	recp := regexp.MustCompile(" cp (-?[0-9]+) ")
-	redm := regexp.MustCompile(" mate (-?[0-9]+) ")
-	bm := move
-	cp := 0
-	dm := 0
-	
-	_, _, err := send("position", fen)
-	if err != nil {
-		log.Fatal("Error: %s", err.Error())
-		return "", 0, 0, err
+// evaluated is a move of a game searched by analyzeGame, waiting to be judged.
+// A known one stands for a position analyzed by an earlier run, which breaks
+// the comparison with the mover's previous move.
+type evaluated struct {
+	fen       string
+	sm        string
+	side      string
+	moveNum   int
+	expected  string
+	id        string
+	smlines   []tactics.EngineInfo
+	best      string
+	bestlines []tactics.EngineInfo
+	known     bool
+	// took is the time spent searching the position so far.
+	took time.Duration
+}
+
+// scored is the score after a move, from the point of view of side, who
+// played it.
+type scored struct {
+	side string
+	info tactics.EngineInfo
+}
+
+// baseline returns the median of the scores in window, from side's point of
+// view, so that a move is judged against the run of the game rather than one
+// evaluation that may be off.
+func baseline(window []scored, side string) tactics.EngineInfo {
+	infos := []tactics.EngineInfo{}
+	for _, s := range window {
+		if s.side == side {
+			infos = append(infos, s.info)
+		} else {
+			infos = append(infos, flipped(s.info))
+		}
 	}
-	info := ""
-	if len(move) == 0 {
-		// find best move
-		bm, info, err = send("go", "movetime", MOVE_TIME)
-	} else {
-		// find cp, dm for move
-		bm, info, err = send("go", "movetime", MOVE_TIME, "searchmoves", move)
+	sort.SliceStable(infos, func(i, j int) bool {
+		return tactics.Worth(infos[i]) < tactics.Worth(infos[j])
+	})
+	return infos[(len(infos)-1)/2]
+}
+
+// flipped returns info from the other side's point of view.
+func flipped(info tactics.EngineInfo) tactics.EngineInfo {
+	info.Cp, info.Mate = -info.Cp, -info.Mate
+	if info.Wdl != nil {
+		info.Wdl = []int{info.Wdl[2], info.Wdl[1], info.Wdl[0]}
 	}
-	
-	if err != nil {
-		log.Fatal("Error: %s", err.Error())
-		return "", 0, 0, err
-	} else {
-		cparr := recp.FindStringSubmatch(info)
-		if len(cparr) > 1 {
-			cp, err = strconv.Atoi(cparr[1])
-			if err != nil {
-				log.Fatal("Error: %s", err.Error())
-				return "", 0, 0, err
+	return info
+}
+
+// dumpEval writes a line to w, if set, with the played move sm's score from
+// the position fen and the best move's when it was searched, along with the
+// blunder found, all from the mover's side.
+func dumpEval(w io.Writer, fen string, sm string, smline tactics.EngineInfo, bm string, bmlines []tactics.EngineInfo, blunder int) {
+	if w == nil {
+		return
+	}
+	line := fmt.Sprintf("eval fen=%q sm=%s cp=%d dm=%d", fen, sm, smline.Cp, smline.Mate)
+	if bmlines != nil {
+		line += fmt.Sprintf(" bm=%s bmcp=%d bmdm=%d", bm, bmlines[0].Cp, bmlines[0].Mate)
+	}
+	fmt.Fprintf(w, "%s blunder=%d\n", line, blunder)
+}
+
+// inOrder passes on results in the order of their games' Seq, holding back
+// those that finish early. Once results is closed any still held back, whose
+// predecessors were never analyzed, follow in order.
+func inOrder(results <-chan Result) <-chan Result {
+	ordered := make(chan Result)
+	go func() {
+		waiting := map[int]Result{}
+		next := 0
+		for res := range results {
+			waiting[res.Game.Seq] = res
+			for r, ok := waiting[next]; ok; r, ok = waiting[next] {
+				delete(waiting, next)
+				next += 1
+				ordered <- r
 			}
 		}
-		dmarr := redm.FindStringSubmatch(info)
-		if len(dmarr) > 1 {
-			dm, err = strconv.Atoi(dmarr[1])
-			if err != nil {
-				log.Fatal("Error: %s", err.Error())
-				return "", 0, 0, err
-			}
+		seqs := []int{}
+		for seq := range waiting {
+			seqs = append(seqs, seq)
+		}
+		sort.Ints(seqs)
+		for _, seq := range seqs {
+			ordered <- waiting[seq]
 		}
+		close(ordered)
+	}()
+	return ordered
+}
+
+// plyOf returns the number of half moves played before the move of record,
+// counting from the start of the game.
+func plyOf(record []string) int {
+	move_num, _ := strconv.Atoi(record[0])
+	ply := (move_num - 1) * 2
+	if sideToMove(record[1]) == "b" {
+		ply += 1
 	}
+	return ply
+}
 
-	return bm, cp, dm, nil
+// sanOrUCI returns move in SAN, keeping it in UCI notation when it can't be
+// converted.
+func sanOrUCI(fen string, move string) string {
+	san, err := toSAN(fen, move)
+	if err != nil {
+		slog.Warn("keeping UCI notation", "err", err)
+		return move
+	}
+	return san
+}
+
+// Result holds the tactics found in one game.
+type Result struct {
+	Game    Game
+	Tactics []Tactic
+	// Positions is the number of moves evaluated, and Times how long each
+	// took to analyze.
+	Positions int
+	Times     []time.Duration
+	// Invalid is the number of moves skipped for having a malformed FEN, and
+	// Illegal those skipped as the played move is illegal in it.
+	Invalid int
+	Illegal int
+	// NoScore is the number of moves skipped as the engine gave no score.
+	NoScore int
+	// Repetitions is the number of moves skipped for repeating a position
+	// analyzed earlier in the game.
+	Repetitions int
+	// Annotated is the number of best move searches of EPD records carrying
+	// a bm operation, and Agreed how many the engine's best move was one of.
+	Annotated int
+	Agreed    int
+	// Known is the number of moves skipped as analyzed by an earlier run, and
+	// Analyzed the positions evaluated this time, kept with -skip-analyzed.
+	Known    int
+	Analyzed []string
+	// Unverified is the number of tactics dropped as the -verify-engine
+	// didn't agree they hold up.
+	Unverified int
+	// Interrupted is set when the analysis stopped before the end of the game.
+	Interrupted bool
+	// Searches is the number of engine searches run, EngineTime the time the
+	// engine reported spending on them and Depth their total depth.
+	Searches   int
+	EngineTime time.Duration
+	Depth      int
+}
+
+// count adds the search that produced line to the engine totals, unless line
+// came from the cache and no search was run.
+func (res *Result) count(line tactics.EngineInfo) {
+	if line.Cached {
+		return
+	}
+	res.Searches += 1
+	res.EngineTime += time.Duration(line.Time) * time.Millisecond
+	res.Depth += line.Depth
 }
 
 func main() {
-	var err error
+	config := flag.String("config", "", "TOML file of flag values, overridden by flags given on the command line")
 	engine := flag.String("engine", "stockfish", "Chess engine full path")
+	engineProtocol := flag.String("engine-protocol", tactics.PROTOCOL_UCI, "Protocol -engine speaks: uci, or cecp for xboard/WinBoard engines")
+	skipAnalyzed := flag.Bool("skip-analyzed", false, "Skip positions analyzed by earlier -skip-analyzed runs, kept in -table's _analyzed table")
+	reanalyzeRows := flag.Bool("reanalyze", false, "Search the tactics already in -table again instead of reading input, updating those that hold up and deleting the rest")
+	serveAddr := flag.String("serve", "", "Address to serve POST /analyze requests on, e.g. :8080, instead of analyzing input")
+	metricsAddr := flag.String("metrics", "", "Address to serve Prometheus /metrics on while analyzing input, e.g. :9090 (-serve serves them on its own address)")
+	input := flag.String("input", "file", "Where to read games from: file (the files named, or standard in) or db, the -source-table rows")
+	sourceTable := flag.String("source-table", "games", "With -input=db, the table of (move_num, fen, move) rows to read, in the -db database")
+	sourceOrder := flag.String("source-order", "", "With -input=db, the -source-table column to read rows in order of, e.g. id; needed to resume with -checkpoint")
+	format := flag.String("format", "csv", "Input format: csv (move number, fen, move) records from db-extract, epd with sm operations, or pgn")
+	output := flag.String("output", "db", "Where to write discovered tactics: db, json for JSON lines, csv for CSV rows or pgn for PGN puzzles, on stdout or to -out")
+	outPath := flag.String("out", "", "File to write -output json, csv or pgn to (default standard output)")
+	baselineFlag := flag.String("baseline", BASELINE_MOVE, "Score each move is compared with: move, the mover's previous one, or game, the median of the "+strconv.Itoa(BASELINE_PLIES)+" half moves before it once the game is searched")
+	prefer := flag.String("prefer", "mate", "Signal classifying a blunder that both mates and loses material: mate, or cp to call it a material_blunder")
+	pvLength := flag.Int("pv-length", PV_LENGTH, "Most moves of the best line to store in pv (0 stores the whole line)")
+	notation := flag.String("notation", "uci", "Notation of the stored sm and bm moves: uci (e.g. g1f3) or san (e.g. Nf3)")
+	dryRun := flag.Bool("dry-run", false, "Analyze and log the tactics found without recording them")
+	countOnly := flag.Bool("count-only", false, "Only count the tactics found by kind, recording and logging none of them")
+	backend := flag.String("db", "mysql", "Database to store tactics in: mysql, postgres or sqlite")
+	dsn := flag.String("dsn", "", "Data source name passed to the database driver, overriding SQLUSER/SQLPASS/SQLIP/SQLPORT")
+	database := flag.String("database", "chess_tactics", "Database name used when the DSN comes from SQLUSER/SQLPASS/SQLIP/SQLPORT")
+	table := flag.String("table", "positions", "Table to store tactics in")
+	sqliteFile := flag.String("sqlite-file", "chess_tactics.db", "Database file used with -db=sqlite")
+	batchSize := flag.Int("batch-size", 100, "Tactics to insert per database transaction")
+	workers := flag.Int("workers", 1, "Number of engine instances analyzing games in parallel")
+	hash := flag.Int("hash", 0, "Engine hash table size in MB (0 keeps the engine default)")
+	syzygyPath := flag.String("syzygy-path", "", "Directories of Syzygy tablebases for the engine to consult, as its SyzygyPath option")
+	threads := flag.Int("threads", 0, "Search threads for each worker's engine (0 keeps the engine default)")
+	multipv := flag.Int("multipv", 1, "Number of ranked engine lines to collect for each best move search")
+	forcingThreshold := flag.Int("forcing-threshold", 0, "Only record tactics whose best move beats the second best by this many centipawns (raises -multipv to at least 2)")
+	var engineArgs stringList
+	flag.Var(&engineArgs, "engine-arg", "Argument to pass to the engine binary (repeat for several)")
+	skillLevel := flag.Int("skill-level", -1, "Engine Skill Level, weakening its play (-1 keeps the engine default)")
+	contempt := flag.Int("contempt", 0, "Engine Contempt in centipawns (only sent when given)")
+	verifyEngine := flag.String("verify-engine", "", "Path to a second UCI engine that must agree each tactic holds up before it is recorded")
+	engineStderr := flag.String("engine-stderr", "", "File to append the engine's standard error to, or none to discard it (default standard error)")
+	dumpEvalFlag := flag.Bool("dump-eval", false, "Write the played and best move scores of every position analyzed to standard error")
+	verbose := flag.Bool("verbose", false, "Log the UCI commands sent to and replies read from the engine (implies -log-level=debug)")
+	logLevel := flag.String("log-level", "info", "Least severe log records to write: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "Log record format: text, or json for a line of JSON per record")
+	singleSearch := flag.Bool("single-search", false, "Score the played move from the best move search's lines when it is among them (raises -multipv to at least "+strconv.Itoa(SINGLE_SEARCH_MULTIPV)+")")
+	chess960 := flag.Bool("chess960", false, "Analyze Fischer Random games by setting UCI_Chess960 on the engine")
+	variant := flag.String("variant", "", "Analyze games of a chess variant the engine supports, e.g. atomic, crazyhouse or horde, by setting UCI_Variant")
+	movetime := flag.Int("movetime", 1000, "Milliseconds to search each move (0 searches to depth "+MAX_DEPTH+" instead)")
+	depth := flag.Int("depth", 0, "Search each move to this depth instead of using movetime")
+	nodes := flag.Int64("nodes", 0, "Search each move this many nodes instead of using movetime, for the same results on any hardware")
+	engineTimeout := flag.Duration("engine-timeout", tactics.EngineTimeout, "Longest to wait for engine output before restarting it (0 waits forever)")
+	cacheSize := flag.Int("cache-size", 100000, "Most evaluations to remember for repeated positions (0 for no limit)")
+	maxRestarts := flag.Int("max-restarts", tactics.MaxRestarts, "Times to restart a crashed engine on the same position before giving up")
+	maxCp := flag.Int("max-cp", MIN_CENTIPAWNS, "Centipawns a move must lose to be considered a blunder")
+	minAdvantage := flag.Int("min-advantage", BLUNDER_CENTIPAWNS, "Centipawns the best move must gain over the played move for the position to be stored")
+	drawBand := flag.Int("draw-band", 0, "Centipawns either side of 0 treated as a draw when a winning position is thrown away (0 disables)")
+	minBlunder := flag.Int("min-blunder", 0, "Smallest blunder to record, letting -max-cp detect smaller drops without storing them")
+	maxMateIn := flag.Int("max-mate-in", MAX_MATE_IN, "Longest mate a move can allow and be considered a blunder")
+	minMoves := flag.Int("min-moves", MIN_MOVES, "First move number of each game to analyze")
+	kindList := flag.String("kinds", "", "Comma separated kinds of tactic to record (default all): "+kindNames())
+	checkpoint := flag.String("checkpoint", "", "File recording how many input records have been analyzed, used to resume an interrupted run")
+	skipPlies := flag.Int("skip-plies", 0, "Half moves to skip at the start of each game, replacing -min-moves when given (0 uses -min-moves)")
+	lastPlies := flag.Int("last-plies", 0, "Only analyze the final half moves of each game, e.g. 20 for time trouble (0 analyzes them all)")
+	maxPlies := flag.Int("max-plies", 0, "Stop analyzing each game after this many half moves (0 analyzes to the end)")
+	reportFile := flag.String("report", "", "File to also write the end of run summary to")
+	maxRuntime := flag.Duration("max-runtime", 0, "Stop cleanly after running this long, e.g. 4h (0 runs to the end of the input)")
+	seed := flag.Int64("seed", 0, "Shuffle the input games with this seed before analyzing them, reading all of it first (0 keeps input order)")
+	limit := flag.Int("limit", 0, "Stop after recording this many tactics (0 records every one found)")
+	since := flag.String("since", "", "With -format=pgn, skip games dated before this day, e.g. 2024-01-31")
+	until := flag.String("until", "", "With -format=pgn, skip games dated after this day")
+	noWarmup := flag.Bool("no-warmup", false, "Don't run a discarded "+tactics.WARMUP_MOVETIME+"ms search when each engine starts")
+	useWDL := flag.Bool("use-wdl", false, "Turn on the engine's UCI_ShowWDL and detect blunders by the fall in winning chances instead of -max-cp")
+	minWinDrop := flag.Int("min-win-drop", 30, "With -use-wdl, percentage points of winning chances a blunder must lose")
+	tacticalOnly := flag.Bool("tactical-only", false, "Only record tactics whose best line mates or opens with a capture or check that wins material")
+	keepHash := flag.Bool("keep-hash", false, "Keep the engine's hash table between games instead of sending ucinewgame")
 	flag.Parse()
-	
-	// start chess engine
-	log.Println("Starting engine: ", *engine)
-	
-	cmd := exec.Command(*engine)
-	
-	cmd.Stderr = os.Stderr
-	EngineIn, err = cmd.StdinPipe()
-	if nil != err {
-		log.Fatalf("Error obtaining stdin: %s", err.Error())
+	// the environment comes before the config file, which only sets flags
+	// neither has
+	if err := loadEnv(); err != nil {
+		fatal(err.Error())
 	}
-	engineOut, err := cmd.StdoutPipe()
-	if nil != err {
-		log.Fatalf("Error obtaining stdout: %s", err.Error())
+	if *config != "" {
+		if err := loadConfig(*config); err != nil {
+			fatal(err.Error())
+		}
 	}
-	EngineReader = bufio.NewScanner(engineOut)
-	
-	if cmd.Start() != nil {
-		log.Fatal(err)
+	if *verbose {
+		*logLevel = "debug"
 	}
-	defer cmd.Process.Kill()
-
-	// read engine hello
-	EngineReader.Scan()
-	log.Println(EngineReader.Text())
-	
-	send("uci")
-
-	sqlstr := os.ExpandEnv("${SQLUSER}:${SQLPASS}@tcp(${SQLIP}:${SQLPORT})/chess_tactics")
-	db, err := sql.Open("mysql", sqlstr)
-	if err != nil {
-		log.Fatal(err)
+	if err := setupLogging(os.Stderr, *logLevel, *logFormat); err != nil {
+		fatal(err.Error())
 	}
-	defer db.Close()
-	
-	stmt, err := db.Prepare("INSERT INTO positions(fen, sm, cp, dm, bm, blunder) VALUES(?, ?, ?, ?, ?, ?)")
+	// the progress line and summary stay out of stdout, which is kept for
+	// -output json and pgn, and aren't log records
+	progress := os.Stderr
+	kinds, err := parseKinds(*kindList)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err.Error())
+	}
+	if *format != "csv" && *format != "epd" && *format != "pgn" {
+		fatal("Unrecognized format: " + *format)
+	}
+	if *input != "file" && *input != "db" {
+		fatal("Unrecognized input: " + *input)
+	}
+	if *input == "db" && !validIdentifier(*sourceTable) {
+		fatal("Bad table name: " + *sourceTable)
+	}
+	if *input == "db" && *sourceOrder != "" && !validIdentifier(*sourceOrder) {
+		fatal("Bad column name: " + *sourceOrder)
+	}
+	if *input == "db" && *checkpoint != "" && *sourceOrder == "" {
+		// without an order the rows skipped on resuming may not be the ones analyzed
+		fatal("-checkpoint with -input=db needs -source-order")
+	}
+	if *notation != "uci" && *notation != "san" {
+		fatal("Unrecognized notation: " + *notation)
+	}
+	if *prefer != tactics.PREFER_MATE && *prefer != tactics.PREFER_CP {
+		fatal("Unrecognized prefer: " + *prefer)
+	}
+	if *workers < 1 {
+		fatal("-workers must be at least 1")
+	}
+	if *engineProtocol != tactics.PROTOCOL_UCI && *engineProtocol != tactics.PROTOCOL_CECP {
+		fatal("Unrecognized engine protocol: " + *engineProtocol)
+	}
+	if *engineProtocol == tactics.PROTOCOL_CECP {
+		// CECP engines report a single line and their moves are only read
+		// for standard chess
+		if *forcingThreshold > 0 || *singleSearch || *multipv > 1 {
+			fatal("-forcing-threshold, -single-search and -multipv need -engine-protocol=uci")
+		}
+		if *chess960 || *variant != "" {
+			fatal("-chess960 and -variant need -engine-protocol=uci")
+		}
+	}
+	if *baselineFlag != BASELINE_MOVE && *baselineFlag != BASELINE_GAME {
+		fatal("Unrecognized baseline: " + *baselineFlag)
+	}
+	if *depth > 0 && *nodes > 0 {
+		fatal("-depth and -nodes can't be used together")
+	}
+	if (*since != "" || *until != "") && *format != "pgn" {
+		fatal("-since and -until need -format=pgn, csv input has no dates")
+	}
+	var sinceDate, untilDate time.Time
+	if *since != "" {
+		if sinceDate, err = parseDate(*since); err != nil {
+			fatal("Unrecognized date: " + *since)
+		}
+	}
+	if *until != "" {
+		if untilDate, err = parseDate(*until); err != nil {
+			fatal("Unrecognized date: " + *until)
+		}
+	}
+	if *skipPlies > 0 {
+		// -skip-plies is the opening cut-off instead of -min-moves
+		*minMoves = 0
+	}
+	settings := Settings{
+		Limit:            searchLimit(*movetime, *depth, *nodes),
+		MinBlunder:       *minBlunder,
+		MinAdvantage:     *minAdvantage,
+		MinMoves:         *minMoves,
+		SkipPlies:        *skipPlies,
+		MaxPlies:         *maxPlies,
+		LastPlies:        *lastPlies,
+		TacticalOnly:     *tacticalOnly,
+		Baseline:         *baselineFlag,
+		ForcingThreshold: *forcingThreshold,
+		KeepHash:         *keepHash,
+		Chess960:         *chess960,
+		Variant:          *variant,
+		Notation:         *notation,
+		PvLength:         *pvLength,
+		SingleSearch:     *singleSearch,
+		Kinds:            kinds,
+		Thresholds: tactics.Thresholds{
+			MinCentipawns: *maxCp,
+			DrawBand:      *drawBand,
+			MaxMateIn:     *maxMateIn,
+			UseWDL:        *useWDL,
+			MinWinDrop:    *minWinDrop,
+			Prefer:        *prefer,
+		},
+	}
+	tactics.MaxRestarts = *maxRestarts
+	tactics.EngineTimeout = *engineTimeout
+	tactics.Verbose = *verbose
+	if *dumpEvalFlag {
+		settings.DumpEval = os.Stderr
 	}
 	
-	stdin := bufio.NewReader(os.Stdin)
-	r := csv.NewReader(stdin)
-	white := true
-	prevwcp, prevbcp, prevcp := 0, 0, 0
-	games := 0
-	for {
-		record, err := r.Read()
-		if err == io.EOF {
-			break
+	if *singleSearch && *multipv < SINGLE_SEARCH_MULTIPV {
+		*multipv = SINGLE_SEARCH_MULTIPV
+	}
+	if *forcingThreshold > 0 && *multipv < 2 {
+		*multipv = 2
+	}
+	options := [][]string{}
+	if *hash > 0 {
+		options = append(options, []string{"Hash", strconv.Itoa(*hash)})
+	}
+	if *syzygyPath != "" {
+		options = append(options, []string{"SyzygyPath", *syzygyPath})
+	}
+	if *threads > 0 {
+		options = append(options, []string{"Threads", strconv.Itoa(*threads)})
+		if *workers * *threads > runtime.NumCPU() {
+			slog.Warn("more engine threads than CPUs", "workers", *workers, "threads", *threads, "cpus", runtime.NumCPU())
 		}
-		if len(record) < 3 {
-			log.Fatal("Records have ", len(record), " items.", record)
+	}
+	if *multipv > 1 {
+		options = append(options, []string{"MultiPV", strconv.Itoa(*multipv)})
+	}
+	if *chess960 {
+		options = append(options, []string{"UCI_Chess960", "true"})
+	}
+	if *variant != "" {
+		options = append(options, []string{"UCI_Variant", *variant})
+	}
+	if *useWDL {
+		options = append(options, []string{"UCI_ShowWDL", "true"})
+	}
+	if *skillLevel >= 0 {
+		options = append(options, []string{"Skill Level", strconv.Itoa(*skillLevel)})
+	}
+	flag.Visit(func(f *flag.Flag) {
+		// 0 is a meaningful contempt, so only send one asked for
+		if f.Name == "contempt" {
+			options = append(options, []string{"Contempt", strconv.Itoa(*contempt)})
 		}
-		move_num, err := strconv.Atoi(record[0])
+	})
+
+	var stderr io.Writer = os.Stderr
+	switch *engineStderr {
+	case "":
+	case "none":
+		stderr = io.Discard
+	default:
+		f, err := os.OpenFile(*engineStderr, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 		if err != nil {
-			log.Fatal(err)
-		} else {
-			if move_num < MIN_MOVES {
-				continue
+			fatal(err.Error())
+		}
+		defer f.Close()
+		stderr = f
+	}
+
+	// start chess engines
+	cache := tactics.NewEvalCache(*cacheSize)
+	engines := []*tactics.Engine{}
+	for i := 0; i < *workers; i++ {
+		slog.Info("starting engine", "path", *engine)
+		e := &tactics.Engine{Path: *engine, Protocol: *engineProtocol, Args: engineArgs, Stderr: stderr, Options: options, Cache: cache, Warmup: !*noWarmup, OnRestart: stats.restart}
+		if err := e.Start(); err != nil {
+			fatal(err.Error())
+		}
+		defer e.Close()
+		engines = append(engines, e)
+	}
+	// read before the workers start, as a Restart rewrites them
+	settings.Engine = engines[0].Name
+	author := engines[0].Author
+	// each worker's verify engine has a cache of its own, so it searches
+	// afresh rather than repeat the primary engine's scores
+	verifiers := make([]*tactics.Engine, len(engines))
+	if *verifyEngine != "" {
+		verifyCache := tactics.NewEvalCache(*cacheSize)
+		for i := range verifiers {
+			slog.Info("starting verify engine", "path", *verifyEngine)
+			e := &tactics.Engine{Path: *verifyEngine, Stderr: stderr, Options: options, Cache: verifyCache, Warmup: !*noWarmup, OnRestart: stats.restart}
+			if err := e.Start(); err != nil {
+				fatal(err.Error())
 			}
+			defer e.Close()
+			verifiers[i] = e
 		}
-		
-		fen := record[1]
-		sm := record[2]
-		blunder := 0
-		
-		// run evaluation of sm
-		_, smcp, smdm, err := eval(fen, sm)
+	}
+
+	// everything stops through ctx: on the first interrupt, once -limit
+	// tactics have been recorded or when -max-runtime runs out; a second
+	// interrupt kills the program outright
+	ctx, halt := context.WithCancel(context.Background())
+	defer halt()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		slog.Info("finishing up", "signal", sig.String())
+		signal.Stop(signals)
+		halt()
+	}()
+	if *maxRuntime > 0 {
+		time.AfterFunc(*maxRuntime, func() {
+			slog.Info("finishing up, reached -max-runtime", "max-runtime", *maxRuntime)
+			halt()
+		})
+	}
+
+	if *serveAddr != "" {
+		// answer queries instead of reading input
+		if err := serve(ctx, *serveAddr, engines, settings); err != nil {
+			fatal(err.Error())
+		}
+		return
+	}
+	if *metricsAddr != "" {
+		serveMetrics(ctx, *metricsAddr)
+	}
+
+	if *skipAnalyzed && (*output != "db" || *dryRun || *countOnly) {
+		fatal("-skip-analyzed needs -output=db")
+	}
+	if *reanalyzeRows {
+		if *output != "db" || *dryRun || *countOnly {
+			fatal("-reanalyze needs -output=db")
+		}
+		db, err := openDB(*backend, *dsn, *sqliteFile, *database, *table)
 		if err != nil {
-			log.Fatal(err.Error())
+			fatal(err.Error())
 		}
+		defer db.Close()
+		kept, deleted, err := reanalyze(ctx, db, *backend, *table, engines, settings)
+		if err != nil {
+			fatal(err.Error())
+		}
+		fmt.Fprintf(progress, "Reanalyzed %d tactics, kept %d and deleted %d\n", kept+deleted, kept, deleted)
+		return
+	}
 
-		if move_num == MIN_MOVES {
-			if white {
-				prevwcp = smcp
-			} else {
-				prevbcp = smcp
+	var out io.Writer = os.Stdout
+	if *outPath != "" {
+		if *output == "db" {
+			fatal("-out needs -output=json, csv or pgn")
+		}
+		f, err := os.Create(*outPath)
+		if err != nil {
+			fatal(err.Error())
+		}
+		defer f.Close()
+		out = f
+	}
+
+	var recorder Recorder
+	switch {
+	case *countOnly:
+		recorder = countRecorder{}
+	case *dryRun:
+		recorder = dryRunRecorder{}
+	case *output == "db":
+		db, err := openDB(*backend, *dsn, *sqliteFile, *database, *table)
+		if err != nil {
+			fatal(err.Error())
+		}
+		dbr, err := newDBRecorder(db, *backend, *table, *batchSize)
+		if err != nil {
+			fatal(err.Error())
+		}
+		if *skipAnalyzed {
+			analyzed := *table + "_analyzed"
+			if settings.Analyzed, err = loadAnalyzed(db, analyzed); err != nil {
+				fatal(err.Error())
 			}
-			// flip move color
-			white = !white
-			
-			if white {
-				// start counting
-				games += 1
-				fmt.Printf("Games: %d\r", games)
+			if err := dbr.trackAnalyzed(analyzed); err != nil {
+				fatal(err.Error())
 			}
-			continue
+			slog.Info("skipping analyzed positions", "table", analyzed, "positions", len(settings.Analyzed))
 		}
-		
-		blunder = 0
-		if white {
-			prevcp = prevwcp
-			prevwcp = smcp
-		} else {
-			prevcp = prevbcp
-			prevbcp = smcp
+		recorder = dbr
+	case *output == "json":
+		recorder = newJSONRecorder(out)
+	case *output == "csv":
+		csvr, err := newCSVRecorder(out)
+		if err != nil {
+			fatal(err.Error())
 		}
-		
-		if smdm < 0 {
-			// look for mate
-			if smdm >= -MAX_MATE_IN {
-				// move results in checkmate in MAX_MATE_IN
-				blunder = 10000
-			}
-		} else if smcp < 0 && smcp < prevcp && prevcp - smcp >= MIN_CENTIPAWNS {
-			// look for bad move by centipawns
-			blunder = prevcp - smcp
+		recorder = csvr
+	case *output == "pgn":
+		recorder = newPGNRecorder(out)
+	default:
+		fatal("Unrecognized output: " + *output)
+	}
+	defer func() {
+		if err := recorder.Close(); err != nil {
+			slog.Error(err.Error())
+		}
+	}()
+	
+	var source *sql.DB
+	if *input == "db" {
+		// the games are only read, so no positions table is created in the
+		// source database
+		source, err = connectDB(*backend, *dsn, *sqliteFile, *database)
+		if err != nil {
+			fatal(err.Error())
 		}
+		defer source.Close()
+	}
 
+	skip := 0
+	if *checkpoint != "" {
+		skip, err = readCheckpoint(*checkpoint)
+		if err != nil {
+			fatal(err.Error())
+		}
+		if skip > 0 {
+			slog.Info("resuming", "records", skip)
+		}
+	}
 
-		if blunder > 0 {
-			// run evaluation for best move
-			bm, bmcp,bmdm, err := eval(fen, "")
-			if err != nil {
-				log.Fatal(err.Error())
+	// analyze games in parallel, one engine per worker, funnelling the
+	// discovered tactics back here for recording
+	games := make(chan Game)
+	results := make(chan Result)
+	var wg sync.WaitGroup
+	for i, e := range engines {
+		var verify Analyzer
+		if verifiers[i] != nil {
+			verify = verifiers[i]
+		}
+		wg.Add(1)
+		go func(e *tactics.Engine, verify Analyzer) {
+			defer wg.Done()
+			for game := range games {
+				results <- analyzeGame(ctx, e, verify, game, settings)
 			}
+		}(e, verify)
+	}
+	go func() {
+		reader := &gameReader{games: games, format: *format, skip: skip, since: sinceDate, until: untilDate, stop: ctx.Done()}
+		if *seed != 0 {
+			reader.shuffle = rand.New(rand.NewSource(*seed))
+		}
+		if source != nil {
+			reader.readTable(source, *sourceTable, *sourceOrder)
+		} else {
+			reader.readInputs(flag.Args())
+		}
+		close(games)
+		wg.Wait()
+		close(results)
+	}()
 
-			if bm != sm && ((bmcp - smcp >= BLUNDER_CENTIPAWNS) || (bmdm > 0 && bmdm < MAX_MATE_IN)) {
-				log.Println("Inserting ", fen, sm, smcp, smdm, bm, blunder, " into database")
-				
-				res, err := stmt.Exec(fen, sm, smcp, smdm, bm, blunder)
-				if err != nil {
-					// possible duplicate
-					//log.Println(err)
-					continue
-				}
-				lastId, err := res.LastInsertId()
-				if err != nil {
-					log.Fatal(err)
-				}
-				rowCnt, err := res.RowsAffected()
-				if err != nil {
-					log.Fatal(err)
-				}
-				
-				log.Printf("ID = %d, affected = %d\n", lastId, rowCnt)
+	var ordered <-chan Result = results
+	if *seed != 0 || *limit > 0 {
+		// record in game order, so which tactics fit under -limit doesn't
+		// depend on how the workers happened to finish
+		ordered = inOrder(results)
+	}
+
+	// games finish out of order, so the checkpoint only advances past games
+	// whose predecessors have all been recorded too
+	finished := map[int]int{}
+	next := 0
+	summary := newReport()
+	summary.engine = settings.Engine
+	if author != "" {
+		summary.engine += " by " + author
+	}
+	total := 0
+	if *format == "csv" && source == nil {
+		total = countRecords(flag.Args())
+	}
+	meter := newProgressMeter(progress, total, skip)
+	// positions already recorded this run, the same position often turns up
+	// in many games
+	seen := map[string]bool{}
+	recorded := 0
+	for res := range ordered {
+		if *limit > 0 && recorded >= *limit {
+			// games still in flight when the limit was reached are left
+			// for the next run
+			continue
+		}
+		partial := false
+		for _, t := range res.Tactics {
+			if *limit > 0 && recorded >= *limit {
+				partial = true
+				break
+			}
+			if seen[t.Fen] {
+				summary.duplicates += 1
+				continue
+			}
+			seen[t.Fen] = true
+			if err := recorder.Record(t); err != nil {
+				fatal(err.Error())
+			}
+			recorded += 1
+		}
+		if *limit > 0 && recorded >= *limit {
+			slog.Info("reached -limit, stopping", "recorded", recorded)
+			halt()
+		}
+		summary.add(res)
+		stats.add(res)
+		if res.Interrupted || partial {
+			// analyze this game again from the start on resume
+			continue
+		}
+		if r, ok := recorder.(*dbRecorder); ok {
+			if err := r.Analyzed(res.Analyzed); err != nil {
+				fatal(err.Error())
 			}
 		}
+		meter.game(len(res.Game.Records))
 
-		// flip move color
-		white = !white
+		finished[res.Game.Seq] = res.Game.End
+		done := -1
+		for end, ok := finished[next]; ok; end, ok = finished[next] {
+			delete(finished, next)
+			next += 1
+			done = end
+		}
+		if *checkpoint != "" && done >= 0 {
+			// the checkpoint must not get ahead of what has been stored
+			if err := recorder.Flush(); err != nil {
+				fatal(err.Error())
+			}
+			if err := writeCheckpoint(*checkpoint, done); err != nil {
+				fatal(err.Error())
+			}
+		}
+	}
+	if err := recorder.Flush(); err != nil {
+		fatal(err.Error())
+	}
+	if r, ok := recorder.(*dbRecorder); ok {
+		summary.duplicates += r.duplicates
+		summary.failed += r.failed
+	}
+	summary.write(progress)
+	if *dryRun {
+		fmt.Fprintln(progress, "Dry run, nothing was recorded")
+	}
+	if *reportFile != "" {
+		if err := summary.writeFile(*reportFile); err != nil {
+			slog.Error(err.Error())
+		}
 	}
 }
-
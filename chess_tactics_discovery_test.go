@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"github.com/atinm/chess_tactics_discovery/tactics"
+)
+
+// fakeAnalyzer scores moves from canned lines instead of searching: played
+// holds the score after each move, keyed by fen and move, and best the best
+// move of each fen with its score.
+type fakeAnalyzer struct {
+	played map[string]tactics.EngineInfo
+	best   map[string]tactics.EngineInfo
+}
+
+func (a *fakeAnalyzer) Eval(ctx context.Context, fen string, moves []string, limit []string) (string, []tactics.EngineInfo, error) {
+	if len(moves) == 0 {
+		line := a.best[fen]
+		return line.Move, []tactics.EngineInfo{line}, nil
+	}
+	line := a.played[fen+"|"+moves[0]]
+	line.Move = moves[0]
+	return moves[0], []tactics.EngineInfo{line}, nil
+}
+
+func (a *fakeAnalyzer) NewGame(ctx context.Context) error {
+	return nil
+}
+
+func (a *fakeAnalyzer) Restart() error {
+	return nil
+}
+
+// TEST_GAME is the opening of a Ruy Lopez, 1. e4 e5 2. Nf3 Nc6 3. Bb5 a6
+// 4. Ba4, as (move number, fen, move) records.
+var TEST_GAME = [][]string{
+	{"1", "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1", "e2e4"},
+	{"1", "rnbqkbnr/pppppppp/8/8/4P3/8/PPPP1PPP/RNBQKBNR b KQkq e3 0 1", "e7e5"},
+	{"2", "rnbqkbnr/pppp1ppp/8/4p3/4P3/8/PPPP1PPP/RNBQKBNR w KQkq e6 0 2", "g1f3"},
+	{"2", "rnbqkbnr/pppp1ppp/8/4p3/4P3/5N2/PPPP1PPP/RNBQKB1R b KQkq - 1 2", "b8c6"},
+	{"3", "r1bqkbnr/pppp1ppp/2n5/4p3/4P3/5N2/PPPP1PPP/RNBQKB1R w KQkq - 2 3", "f1b5"},
+	{"3", "r1bqkbnr/pppp1ppp/2n5/1B2p3/4P3/5N2/PPPP1PPP/RNBQK2R b KQkq - 3 3", "a7a6"},
+	{"4", "r1bqkbnr/1ppp1ppp/p1n5/1B2p3/4P3/5N2/PPPP1PPP/RNBQK2R w KQkq - 0 4", "b5a4"},
+}
+
+// testAnalyzer scores TEST_GAME with one blunder of each branch: Black's
+// 2... Nc6 drops 330 centipawns from behind, White's 3. Bb5 walks into a mate
+// in 2 from ahead, Black's 3... a6 passes up that mate and White's 4. Ba4
+// allows a mate too long to count.
+func testAnalyzer() *fakeAnalyzer {
+	played := []tactics.EngineInfo{{Cp: 30}, {Cp: -20}, {Cp: 40}, {Cp: -350}, {Mate: -2}, {Cp: 200}, {Mate: -8}}
+	a := &fakeAnalyzer{played: map[string]tactics.EngineInfo{}, best: map[string]tactics.EngineInfo{
+		TEST_GAME[3][1]: {Move: "g8f6", Cp: 20, Pv: []string{"g8f6"}},
+		TEST_GAME[4][1]: {Move: "f1c4", Cp: 100, Pv: []string{"f1c4"}},
+		TEST_GAME[5][1]: {Move: "g8f6", Mate: 2, Pv: []string{"g8f6"}},
+	}}
+	for i, record := range TEST_GAME {
+		a.played[record[1]+"|"+record[2]] = played[i]
+	}
+	return a
+}
+
+func TestAnalyzeGame(t *testing.T) {
+	settings := Settings{Thresholds: tactics.Thresholds{MinCentipawns: 100, MaxMateIn: 5}, MinAdvantage: 50}
+	res := analyzeGame(context.Background(), testAnalyzer(), nil, Game{Records: TEST_GAME}, settings)
+	if res.Positions != len(TEST_GAME) {
+		t.Errorf("analyzed %d positions, want %d", res.Positions, len(TEST_GAME))
+	}
+	want := []Tactic{
+		{Fen: TEST_GAME[3][1], Sm: "b8c6", Cp: 350, Bm: "g8f6", Blunder: 330, Pv: "g8f6", Kind: tactics.MATERIAL_BLUNDER, MoveNum: 2, Side: "b"},
+		{Fen: TEST_GAME[4][1], Sm: "f1b5", Dm: -2, Bm: "f1c4", Blunder: -tactics.MATE_BLUNDER, Pv: "f1c4", Kind: tactics.MATE_ALLOWED, MoveNum: 3, Side: "w"},
+		{Fen: TEST_GAME[5][1], Sm: "a7a6", Cp: -200, Bm: "g8f6", Blunder: -tactics.MISSED_MATE_BLUNDER, Pv: "g8f6", Kind: tactics.MATE_MISSED, MoveNum: 3, Side: "b"},
+	}
+	if len(res.Tactics) != len(want) {
+		t.Fatalf("found %d tactics, want %d: %+v", len(res.Tactics), len(want), res.Tactics)
+	}
+	for i := range want {
+		if got := judged(res.Tactics[i]); got != want[i] {
+			t.Errorf("tactic %d = %+v, want %+v", i, got, want[i])
+		}
+	}
+}
+
+// judged keeps the fields of t that the blunder branches decide, leaving out
+// the search statistics and ratings.
+func judged(t Tactic) Tactic {
+	return Tactic{Fen: t.Fen, Sm: t.Sm, Cp: t.Cp, Dm: t.Dm, Bm: t.Bm, Blunder: t.Blunder, Pv: t.Pv, Kind: t.Kind, MoveNum: t.MoveNum, Side: t.Side}
+}
+
+func TestAnalyzeGameKinds(t *testing.T) {
+	settings := Settings{Thresholds: tactics.Thresholds{MinCentipawns: 100, MaxMateIn: 5}, MinAdvantage: 50, Kinds: map[tactics.Kind]bool{tactics.MATE_MISSED: true}}
+	res := analyzeGame(context.Background(), testAnalyzer(), nil, Game{Records: TEST_GAME}, settings)
+	if len(res.Tactics) != 1 || res.Tactics[0].Kind != tactics.MATE_MISSED {
+		t.Errorf("tactics = %+v, want only the mate_missed one", res.Tactics)
+	}
+}
+
+func TestAnalyzeGameDrawBand(t *testing.T) {
+	// White's 3. Bb5 throws away a 350 centipawn edge to a level position
+	a := testAnalyzer()
+	a.played[TEST_GAME[2][1]+"|"+TEST_GAME[2][2]] = tactics.EngineInfo{Cp: 350}
+	a.played[TEST_GAME[4][1]+"|"+TEST_GAME[4][2]] = tactics.EngineInfo{Cp: 5}
+	a.best[TEST_GAME[4][1]] = tactics.EngineInfo{Move: "f1c4", Cp: 400, Pv: []string{"f1c4"}}
+	settings := Settings{Thresholds: tactics.Thresholds{MinCentipawns: 100, DrawBand: 20, MaxMateIn: 5}, MinAdvantage: 50, Kinds: map[tactics.Kind]bool{tactics.DRAW_BLUNDER: true}}
+	res := analyzeGame(context.Background(), a, nil, Game{Records: TEST_GAME}, settings)
+	if len(res.Tactics) != 1 || res.Tactics[0].Sm != "f1b5" || res.Tactics[0].Blunder != -345 {
+		t.Errorf("tactics = %+v, want 3. Bb5 as a draw_blunder of -345", res.Tactics)
+	}
+}
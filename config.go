@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"github.com/BurntSushi/toml"
+)
+
+// ENV_PREFIX starts the environment variables loadEnv reads flags from.
+const ENV_PREFIX = "CTD_"
+
+// loadConfig sets flags from the TOML file name, whose keys are flag names
+// (e.g. movetime = 500, db = "sqlite"). Flags given on the command line keep
+// their values. An array sets a repeatable flag once for each element.
+func loadConfig(name string) error {
+	values := map[string]interface{}{}
+	if _, err := toml.DecodeFile(name, &values); err != nil {
+		return err
+	}
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for key, value := range values {
+		if flag.Lookup(key) == nil {
+			return fmt.Errorf("%s: unrecognized flag %s", name, key)
+		}
+		if set[key] {
+			continue
+		}
+		list, ok := value.([]interface{})
+		if !ok {
+			list = []interface{}{value}
+		}
+		for _, v := range list {
+			if err := flag.Set(key, fmt.Sprint(v)); err != nil {
+				return fmt.Errorf("%s: %s: %s", name, key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// loadEnv sets flags from environment variables named ENV_PREFIX and the flag
+// name in upper case with dashes as underscores (CTD_MOVETIME, CTD_MAX_CP).
+// Flags given on the command line keep their values.
+func loadEnv() error {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		name := ENV_PREFIX + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		value, ok := os.LookupEnv(name)
+		if !ok || set[f.Name] || err != nil {
+			return
+		}
+		if serr := flag.Set(f.Name, value); serr != nil {
+			err = fmt.Errorf("%s: invalid value %q: %s", name, value, serr)
+		}
+	})
+	return err
+}
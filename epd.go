@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// parseEPD splits an EPD record into a full FEN and its operations, keyed by
+// opcode. The halfmove clock and fullmove number come from the hmvc and fmvn
+// operations, defaulting to 0 and 1. String operands are unquoted.
+func parseEPD(line string) (string, map[string][]string, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 {
+		return "", nil, errors.New("expected 4 position fields, found " + strconv.Itoa(len(fields)))
+	}
+	rest := line
+	for i := 0; i < 4; i++ {
+		rest = strings.TrimLeft(rest, " \t")
+		rest = rest[len(fields[i]):]
+	}
+
+	ops := map[string][]string{}
+	tokens := []string{}
+	token, quoted, inToken := "", false, false
+	for _, c := range rest {
+		switch {
+		case c == '"':
+			quoted = !quoted
+			inToken = true
+		case quoted:
+			token += string(c)
+		case c == ' ' || c == '\t' || c == ';':
+			if inToken {
+				tokens = append(tokens, token)
+				token, inToken = "", false
+			}
+			if c == ';' && len(tokens) > 0 {
+				ops[tokens[0]] = tokens[1:]
+				tokens = []string{}
+			}
+		default:
+			token += string(c)
+			inToken = true
+		}
+	}
+	if quoted {
+		return "", nil, errors.New("unterminated string in " + rest)
+	}
+	if inToken {
+		tokens = append(tokens, token)
+	}
+	if len(tokens) > 0 {
+		return "", nil, errors.New("operation " + tokens[0] + " missing its ;")
+	}
+
+	hmvc, fmvn := "0", "1"
+	if op := ops["hmvc"]; len(op) > 0 {
+		hmvc = op[0]
+	}
+	if op := ops["fmvn"]; len(op) > 0 {
+		fmvn = op[0]
+	}
+	return strings.Join(append(fields[:4], hmvc, fmvn), " "), ops, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseEPD(t *testing.T) {
+	const board = "r1bqkbnr/pppp1ppp/2n5/4p3/4P3/5N2/PPPP1PPP/RNBQKB1R w KQkq -"
+	tests := []struct {
+		name string
+		epd  string
+		fen  string
+		ops  map[string][]string
+	}{
+		{
+			"several bm moves",
+			board + " bm Bb5 Bc4; id \"open.1\";",
+			board + " 0 1",
+			map[string][]string{"bm": {"Bb5", "Bc4"}, "id": {"open.1"}},
+		},
+		{
+			"quoted operand holding a ;",
+			board + " bm Bb5; id \"Ruy; or Italian\"; c0 \"\";",
+			board + " 0 1",
+			map[string][]string{"bm": {"Bb5"}, "id": {"Ruy; or Italian"}, "c0": {""}},
+		},
+		{
+			"missing id",
+			board + "\tbm Nxe5+;  hmvc 2; fmvn 3;",
+			board + " 2 3",
+			map[string][]string{"bm": {"Nxe5+"}, "hmvc": {"2"}, "fmvn": {"3"}},
+		},
+		{
+			"no operations",
+			board,
+			board + " 0 1",
+			map[string][]string{},
+		},
+	}
+	for _, test := range tests {
+		fen, ops, err := parseEPD(test.epd)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if fen != test.fen || !reflect.DeepEqual(ops, test.ops) {
+			t.Errorf("%s: parseEPD = %q %q, want %q %q", test.name, fen, ops, test.fen, test.ops)
+		}
+	}
+}
+
+func TestParseEPDErrors(t *testing.T) {
+	for _, epd := range []string{
+		"8/8/8/8 w",
+		"r1bqkbnr/pppp1ppp/2n5/4p3/4P3/5N2/PPPP1PPP/RNBQKB1R w KQkq - id \"open.1;",
+		"r1bqkbnr/pppp1ppp/2n5/4p3/4P3/5N2/PPPP1PPP/RNBQKB1R w KQkq - bm Bb5; id \"open.1\"",
+	} {
+		if _, _, err := parseEPD(epd); err == nil {
+			t.Errorf("parseEPD(%q) succeeded, want an error", epd)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// validateFEN checks that fen has the six fields of a FEN string, the first
+// four well formed, and returns an error describing the first problem found.
+// The move counters are left to tactics.NormalizeFEN, which replaces
+// malformed ones before checkFEN is called. With chess960 set, Shredder-FEN
+// castling rights naming the rook files (e.g. HAha) are accepted as well as
+// KQkq.
+func validateFEN(fen string, chess960 bool) error {
+	fields := strings.Fields(fen)
+	if len(fields) != 6 {
+		return errors.New("expected 6 fields, found " + strconv.Itoa(len(fields)))
+	}
+
+	ranks := strings.Split(fields[0], "/")
+	if len(ranks) != 8 {
+		return errors.New("expected 8 ranks, found " + strconv.Itoa(len(ranks)))
+	}
+	kings := map[rune]int{}
+	for _, rank := range ranks {
+		squares := 0
+		for _, c := range rank {
+			switch {
+			case c >= '1' && c <= '8':
+				squares += int(c - '0')
+			case strings.ContainsRune("pnbrqkPNBRQK", c):
+				squares += 1
+				if c == 'k' || c == 'K' {
+					kings[c] += 1
+				}
+			default:
+				return errors.New("bad piece " + strconv.QuoteRune(c) + " in rank " + rank)
+			}
+		}
+		if squares != 8 {
+			return errors.New("rank " + rank + " has " + strconv.Itoa(squares) + " squares")
+		}
+	}
+	if kings['K'] != 1 || kings['k'] != 1 {
+		return errors.New("each side needs exactly one king")
+	}
+
+	if fields[1] != "w" && fields[1] != "b" {
+		return errors.New("bad side to move " + fields[1])
+	}
+
+	castling := "KQkq"
+	if chess960 {
+		castling += "ABCDEFGHabcdefgh"
+	}
+	if fields[2] != "-" {
+		for i, c := range fields[2] {
+			if !strings.ContainsRune(castling, c) || strings.ContainsRune(fields[2][:i], c) {
+				return errors.New("bad castling rights " + fields[2])
+			}
+		}
+	}
+
+	ep := fields[3]
+	if ep != "-" && (len(ep) != 2 || ep[0] < 'a' || ep[0] > 'h' || (ep[1] != '3' && ep[1] != '6')) {
+		return errors.New("bad en passant square " + ep)
+	}
+	return nil
+}
+
+// checkFEN validates fen as settings expect it: a standard or Chess960 FEN,
+// or with settings.Variant the looser variantFEN check. Callers pass it
+// through tactics.NormalizeFEN first, so a FEN missing its move counters, or
+// with malformed ones, is checked with 0 1 in their place.
+func checkFEN(fen string, settings Settings) error {
+	if settings.Variant != "" {
+		return variantFEN(fen)
+	}
+	return validateFEN(fen, settings.Chess960)
+}
+
+// variantFEN checks only what the analysis relies on in the FEN of a chess
+// variant, whose boards may hold pieces in hand (crazyhouse), lack a king
+// (horde, antichess) or carry an extra field (three-check), leaving the rest
+// to the engine: a board and a side to move of w or b.
+func variantFEN(fen string) error {
+	fields := strings.Fields(fen)
+	if len(fields) < 4 {
+		return errors.New("expected at least 4 fields, found " + strconv.Itoa(len(fields)))
+	}
+	if fields[1] != "w" && fields[1] != "b" {
+		return errors.New("bad side to move " + fields[1])
+	}
+	return nil
+}
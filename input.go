@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"encoding/csv"
+	"io"
+	"log/slog"
+	"math/rand"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/notnil/chess"
+	"github.com/atinm/chess_tactics_discovery/tactics"
+)
+
+// Game is the (move number, fen, move) records of one game.
+type Game struct {
+	// Seq numbers the games in input order, from 0.
+	Seq int
+	// End is the number of input records read up to the end of this game.
+	End     int
+	Records [][]string
+}
+
+// gameReader splits its input into games and sends them on games.
+type gameReader struct {
+	games chan<- Game
+	// format is the input format: csv records from db-extract, epd or pgn.
+	format string
+	// skip is the number of input records to pass over before reading games,
+	// as saved in a checkpoint.
+	skip int
+	// since and until, when set, skip PGN games dated outside them.
+	since time.Time
+	until time.Time
+	// shuffle, if set, holds back every game until the input is read and
+	// sends them in a random order drawn from it.
+	shuffle  *rand.Rand
+	buffered []Game
+	// stop ends reading when it is closed.
+	stop    <-chan struct{}
+	records int
+	seq     int
+}
+
+// readInputs reads games from each of the named files in turn, or from
+// standard in when there are none. Files that can't be opened are skipped.
+func (g *gameReader) readInputs(names []string) {
+	g.readAll(func() {
+		g.readFiles(names)
+	})
+}
+
+// readTable reads games from the (move_num, fen, move) rows of the table
+// source in db, ordered by the column order, or in the order the database
+// returns them when order is empty.
+func (g *gameReader) readTable(db *sql.DB, source string, order string) {
+	g.readAll(func() {
+		g.readRows(db, source, order)
+	})
+}
+
+// readAll calls read to read the input, shuffling the games it sends when
+// shuffle is set.
+func (g *gameReader) readAll(read func()) {
+	if g.shuffle == nil {
+		read()
+		return
+	}
+	// the checkpoint counts records in shuffled order
+	skip := g.skip
+	g.skip = 0
+	read()
+	g.skip = skip
+	g.sendShuffled()
+}
+
+// readFiles reads games from the named files, or standard in, for readInputs.
+func (g *gameReader) readFiles(names []string) {
+	if len(names) == 0 {
+		g.read(os.Stdin)
+		return
+	}
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			slog.Warn("skipping input", "name", name, "err", err)
+			continue
+		}
+		more := g.read(f)
+		f.Close()
+		if !more {
+			return
+		}
+	}
+}
+
+// read reads the games in r according to format, returning false if reading
+// was stopped. Gzipped input is decompressed.
+func (g *gameReader) read(r io.Reader) bool {
+	r, err := gunzip(r)
+	if err != nil {
+		slog.Warn("skipping input", "err", err)
+		return true
+	}
+	if g.format == "pgn" {
+		return g.readPGN(r)
+	}
+	if g.format == "epd" {
+		return g.readEPD(r)
+	}
+	records := csv.NewReader(r)
+	// db-extract sometimes appends fields, only the first three are used
+	records.FieldsPerRecord = -1
+	return g.readGames(records.Read)
+}
+
+// readRows reads the records of readTable.
+func (g *gameReader) readRows(db *sql.DB, source string, order string) {
+	query := "SELECT move_num, fen, move FROM " + source
+	if order != "" {
+		query += " ORDER BY " + order
+	}
+	rows, err := db.Query(query)
+	if err != nil {
+		slog.Error("reading input", "table", source, "err", err)
+		return
+	}
+	defer rows.Close()
+	g.readGames(func() ([]string, error) {
+		if !rows.Next() {
+			if err := rows.Err(); err != nil {
+				slog.Error("reading input", "table", source, "err", err)
+			}
+			return nil, io.EOF
+		}
+		record := make([]string, 3)
+		if err := rows.Scan(&record[0], &record[1], &record[2]); err != nil {
+			return nil, err
+		}
+		return record, nil
+	})
+}
+
+// gunzip returns a reader decompressing r if it starts with the gzip magic
+// number, and a buffered r otherwise.
+func gunzip(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+// readGames groups the records returned by next, until io.EOF, into games,
+// starting a new game whenever the move number goes backwards. It returns
+// false if reading was stopped.
+func (g *gameReader) readGames(next func() ([]string, error)) bool {
+	game := [][]string{}
+	last := 0
+	for {
+		record, err := next()
+		if err == io.EOF {
+			break
+		}
+		// bad records still count towards the checkpoint
+		if err != nil {
+			slog.Warn("skipping record", "err", err)
+			g.records += 1
+			continue
+		}
+		if len(record) < 3 {
+			slog.Warn("skipping short record", "items", len(record), "record", record)
+			g.records += 1
+			continue
+		}
+		move_num, err := strconv.Atoi(record[0])
+		if err != nil {
+			slog.Warn("skipping record", "record", record, "err", err)
+			g.records += 1
+			continue
+		}
+		record = record[:3]
+		if g.records < g.skip {
+			g.records += 1
+			continue
+		}
+		if move_num < last && len(game) > 0 {
+			if !g.send(game) {
+				return false
+			}
+			game = [][]string{}
+		}
+		last = move_num
+		game = append(game, record)
+		g.records += 1
+	}
+	if len(game) > 0 {
+		return g.send(game)
+	}
+	return true
+}
+
+// readEPD groups the EPD records read from r into games like readGames, by
+// their fmvn operation. Each record needs an sm operation for the move played,
+// a bm operation, or both; its bm moves, in UCI and space separated, and its id
+// ride along as the fourth and fifth fields, with an empty move when there is
+// no sm. It returns false if reading was stopped.
+func (g *gameReader) readEPD(r io.Reader) bool {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), tactics.MAX_LINE)
+	game := [][]string{}
+	last := 0
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			g.records += 1
+			continue
+		}
+		fen, ops, err := parseEPD(line)
+		if err != nil {
+			slog.Warn("skipping record", "record", line, "err", err)
+			g.records += 1
+			continue
+		}
+		if len(ops["sm"]) == 0 && len(ops["bm"]) == 0 {
+			slog.Warn("skipping record without an sm or bm operation", "record", line)
+			g.records += 1
+			continue
+		}
+		fields := strings.Fields(fen)
+		move_num, err := strconv.Atoi(fields[5])
+		if err != nil {
+			slog.Warn("skipping record", "record", line, "err", err)
+			g.records += 1
+			continue
+		}
+		if g.records < g.skip {
+			g.records += 1
+			continue
+		}
+		sm := ""
+		if len(ops["sm"]) > 0 {
+			if sm, err = toUCI(fen, ops["sm"][0]); err != nil {
+				sm = ops["sm"][0]
+			}
+		}
+		bms := []string{}
+		for _, move := range ops["bm"] {
+			if uci, err := toUCI(fen, move); err == nil {
+				move = uci
+			}
+			bms = append(bms, move)
+		}
+		id := strings.Join(ops["id"], " ")
+		if move_num < last && len(game) > 0 {
+			if !g.send(game) {
+				return false
+			}
+			game = [][]string{}
+		}
+		last = move_num
+		game = append(game, []string{fields[5], fen, sm, strings.Join(bms, " "), id})
+		g.records += 1
+	}
+	if err := scanner.Err(); err != nil {
+		slog.Warn("reading input", "err", err)
+	}
+	if len(game) > 0 {
+		return g.send(game)
+	}
+	return true
+}
+
+// readPGN replays each game in the PGN read from r, producing a record of the
+// fullmove number, FEN and UCI move for every ply. Games that fail to parse
+// are skipped. It returns false if reading was stopped.
+func (g *gameReader) readPGN(r io.Reader) bool {
+	more := true
+	err := splitPGN(r, func(text string) bool {
+		opt, err := chess.PGN(strings.NewReader(text))
+		if err != nil {
+			slog.Warn("skipping game", "err", err)
+			return true
+		}
+		game := chess.NewGame(opt)
+		records := [][]string{}
+		positions := game.Positions()
+		for i, move := range game.Moves() {
+			fen := positions[i].String()
+			fields := strings.Fields(fen)
+			records = append(records, []string{fields[len(fields)-1], fen, move.String()})
+		}
+		if len(records) == 0 {
+			return true
+		}
+		if !g.inWindow(game) {
+			// still counted, so checkpoints line up with the input
+			g.records += len(records)
+			return true
+		}
+		// checkpoints are taken at the end of games, so skip whole games
+		if g.records + len(records) <= g.skip {
+			g.records += len(records)
+			return true
+		}
+		g.records += len(records)
+		more = g.send(records)
+		return more
+	})
+	if err != nil {
+		slog.Warn("skipping rest of input", "err", err)
+	}
+	return more
+}
+
+// retag matches a line holding a PGN tag pair.
+var retag = regexp.MustCompile(`^\[\w+ ".*"\]$`)
+
+// splitPGN reads r a line at a time, passing the text of each game in turn
+// to game until it returns false, so only one game of a many gigabyte PGN
+// file is held in memory. A game ends where the tag pairs of the next one
+// begin; a line inside a {} comment, such as a wrapped [%clk], is never a tag
+// pair and is joined to the line before it. A comment left open still ends
+// at a blank line followed by a tag pair, so a game with an unterminated one
+// doesn't swallow the rest of the file.
+func splitPGN(r io.Reader, game func(text string) bool) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), tactics.MAX_LINE)
+	var text strings.Builder
+	inMoves, inComment, blank := false, false, false
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if inComment && blank && retag.MatchString(trimmed) {
+			inComment = false
+		}
+		blank = trimmed == ""
+		tag := !inComment && retag.MatchString(trimmed)
+		if tag && inMoves {
+			if !game(text.String()) {
+				return nil
+			}
+			text.Reset()
+			inMoves = false
+		}
+		if trimmed != "" && !tag {
+			inMoves = true
+			inComment = commentOpen(trimmed, inComment)
+		}
+		text.WriteString(line)
+		if inComment {
+			// the parser would take a wrapped line starting with [ for a
+			// tag pair too, so keep comments on one line
+			text.WriteString(" ")
+		} else {
+			text.WriteString("\n")
+		}
+	}
+	if inMoves {
+		game(text.String())
+	}
+	return scanner.Err()
+}
+
+// commentOpen reports whether a {} comment is still open at the end of the
+// movetext line, given whether one was open at its start. A ; comment runs to
+// the end of the line, braces and all.
+func commentOpen(line string, open bool) bool {
+	for _, c := range line {
+		switch {
+		case open:
+			open = c != '}'
+		case c == '{':
+			open = true
+		case c == ';':
+			return false
+		}
+	}
+	return open
+}
+
+// inWindow reports whether game's Date tag falls within since and until.
+// Games without a complete date are outside any window.
+func (g *gameReader) inWindow(game *chess.Game) bool {
+	if g.since.IsZero() && g.until.IsZero() {
+		return true
+	}
+	tag := game.GetTagPair("Date")
+	if tag == nil {
+		return false
+	}
+	date, err := parseDate(tag.Value)
+	if err != nil {
+		return false
+	}
+	if !g.since.IsZero() && date.Before(g.since) {
+		return false
+	}
+	if !g.until.IsZero() && date.After(g.until) {
+		return false
+	}
+	return true
+}
+
+// parseDate parses a date written 2006-01-02 or, as in PGN Date tags,
+// 2006.01.02.
+func parseDate(s string) (time.Time, error) {
+	return time.Parse("2006-01-02", strings.ReplaceAll(s, ".", "-"))
+}
+
+// send passes records on as the next game, returning false if reading has
+// been stopped.
+func (g *gameReader) send(records [][]string) bool {
+	if g.shuffle != nil {
+		g.buffered = append(g.buffered, Game{g.seq, g.records, records})
+		g.seq += 1
+		return true
+	}
+	select {
+	case g.games <- Game{g.seq, g.records, records}:
+		g.seq += 1
+		return true
+	case <-g.stop:
+		return false
+	}
+}
+
+// sendShuffled sends the buffered games in an order drawn from shuffle,
+// numbering them and counting their input records in that order, so the same
+// seed gives the same games for a checkpoint to skip.
+func (g *gameReader) sendShuffled() {
+	// input records each game took up, including bad ones
+	sizes := make([]int, len(g.buffered))
+	prev := 0
+	for i, game := range g.buffered {
+		sizes[i] = game.End - prev
+		prev = game.End
+	}
+	g.seq = 0
+	end := 0
+	for _, i := range g.shuffle.Perm(len(g.buffered)) {
+		end += sizes[i]
+		if end <= g.skip {
+			continue
+		}
+		game := g.buffered[i]
+		game.Seq, game.End = g.seq, end
+		select {
+		case g.games <- game:
+			g.seq += 1
+		case <-g.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// splitGames returns the games splitPGN finds in pgn.
+func splitGames(t *testing.T, pgn string) []string {
+	t.Helper()
+	games := []string{}
+	err := splitPGN(strings.NewReader(pgn), func(text string) bool {
+		games = append(games, text)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return games
+}
+
+func TestSplitPGN(t *testing.T) {
+	tests := []struct {
+		name string
+		pgn  string
+		want []string
+	}{
+		{
+			"two games",
+			"[Event \"A\"]\n[White \"x\"]\n\n1. e4 e5 1-0\n\n[Event \"B\"]\n\n1. d4 d5 0-1\n",
+			[]string{"[Event \"A\"]\n[White \"x\"]\n\n1. e4 e5 1-0\n\n", "[Event \"B\"]\n\n1. d4 d5 0-1\n"},
+		},
+		{
+			"tag pair inside a comment",
+			"[Event \"A\"]\n\n1. e4 {quoting\n[Event \"B\"] here} e5 1-0\n\n[Event \"C\"]\n\n1. d4 0-1\n",
+			[]string{"[Event \"A\"]\n\n1. e4 {quoting [Event \"B\"] here} e5 1-0\n\n", "[Event \"C\"]\n\n1. d4 0-1\n"},
+		},
+		{
+			"multi-line comment",
+			"[Event \"A\"]\n\n1. e4 { [%clk 0:03:00]\n[%clk 0:02:59]\n\nstill open } e5 1-0\n",
+			[]string{"[Event \"A\"]\n\n1. e4 { [%clk 0:03:00] [%clk 0:02:59]  still open } e5 1-0\n"},
+		},
+		{
+			"; comment with a brace",
+			"[Event \"A\"]\n\n1. e4 ; a { here\ne5 1-0\n\n[Event \"B\"]\n\n1. d4 0-1\n",
+			[]string{"[Event \"A\"]\n\n1. e4 ; a { here\ne5 1-0\n\n", "[Event \"B\"]\n\n1. d4 0-1\n"},
+		},
+		{
+			"unterminated comment",
+			"[Event \"A\"]\n\n1. e4 {broken e5 1-0\n\n[Event \"B\"]\n\n1. d4 d5 0-1\n\n[Event \"C\"]\n\n1. c4 1-0\n",
+			[]string{"[Event \"A\"]\n\n1. e4 {broken e5 1-0  ", "[Event \"B\"]\n\n1. d4 d5 0-1\n\n", "[Event \"C\"]\n\n1. c4 1-0\n"},
+		},
+	}
+	for _, test := range tests {
+		got := splitGames(t, test.pgn)
+		if len(got) != len(test.want) {
+			t.Errorf("%s: split into %d games %q, want %d", test.name, len(got), got, len(test.want))
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: game %d = %q, want %q", test.name, i+1, got[i], test.want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// setupLogging sends log records at level (debug, info, warn or error) and
+// above to w, formatted as text or json lines.
+func setupLogging(w io.Writer, level string, format string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return errors.New("Unrecognized log level: " + level)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(w, opts)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(w, opts)))
+	default:
+		return errors.New("Unrecognized log format: " + format)
+	}
+	return nil
+}
+
+// fatal logs msg and args as an error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+	"github.com/atinm/chess_tactics_discovery/tactics"
+)
+
+// ANALYSIS_BUCKETS are the upper bounds, in seconds, of the per-position
+// analysis time histogram.
+var ANALYSIS_BUCKETS = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// metrics holds the counters served on /metrics in the Prometheus text
+// format, shared by every worker.
+type metrics struct {
+	mu        sync.Mutex
+	positions int64
+	tactics   map[tactics.Kind]int64
+	restarts  int64
+	// errors counts the positions that could not be analyzed.
+	errors int64
+	// buckets counts the positions analyzed within each ANALYSIS_BUCKETS
+	// bound, and seconds their total time.
+	buckets []int64
+	seconds float64
+}
+
+// stats collects the run's metrics, served with -metrics or -serve.
+var stats = newMetrics()
+
+func newMetrics() *metrics {
+	return &metrics{tactics: map[tactics.Kind]int64{}, buckets: make([]int64, len(ANALYSIS_BUCKETS))}
+}
+
+// position counts a position analyzed in took.
+func (m *metrics) position(took time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.positions += 1
+	m.seconds += took.Seconds()
+	for i, bound := range ANALYSIS_BUCKETS {
+		if took.Seconds() <= bound {
+			m.buckets[i] += 1
+		}
+	}
+}
+
+// tactic counts a tactic found of kind.
+func (m *metrics) tactic(kind tactics.Kind) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tactics[kind] += 1
+}
+
+// restart counts an engine restart.
+func (m *metrics) restart() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.restarts += 1
+}
+
+// failed counts a position that could not be analyzed.
+func (m *metrics) failed() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors += 1
+}
+
+// add counts the positions analyzed, and the tactics found, in res.
+func (m *metrics) add(res Result) {
+	for _, took := range res.Times {
+		m.position(took)
+	}
+	for _, t := range res.Tactics {
+		m.tactic(t.Kind)
+	}
+	m.mu.Lock()
+	m.errors += int64(res.NoScore)
+	m.mu.Unlock()
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP ctd_positions_analyzed_total Positions analyzed.\n")
+	fmt.Fprintf(w, "# TYPE ctd_positions_analyzed_total counter\n")
+	fmt.Fprintf(w, "ctd_positions_analyzed_total %d\n", m.positions)
+	fmt.Fprintf(w, "# HELP ctd_tactics_found_total Tactics found, by kind.\n")
+	fmt.Fprintf(w, "# TYPE ctd_tactics_found_total counter\n")
+	kinds := append([]tactics.Kind{}, tactics.KINDS...)
+	sort.Slice(kinds, func(i, j int) bool {
+		return kinds[i] < kinds[j]
+	})
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "ctd_tactics_found_total{kind=%q} %d\n", kind, m.tactics[kind])
+	}
+	fmt.Fprintf(w, "# HELP ctd_engine_restarts_total Engines restarted after dying or timing out.\n")
+	fmt.Fprintf(w, "# TYPE ctd_engine_restarts_total counter\n")
+	fmt.Fprintf(w, "ctd_engine_restarts_total %d\n", m.restarts)
+	fmt.Fprintf(w, "# HELP ctd_analysis_errors_total Positions that could not be analyzed.\n")
+	fmt.Fprintf(w, "# TYPE ctd_analysis_errors_total counter\n")
+	fmt.Fprintf(w, "ctd_analysis_errors_total %d\n", m.errors)
+	fmt.Fprintf(w, "# HELP ctd_position_analysis_seconds Time taken to analyze each position.\n")
+	fmt.Fprintf(w, "# TYPE ctd_position_analysis_seconds histogram\n")
+	for i, bound := range ANALYSIS_BUCKETS {
+		fmt.Fprintf(w, "ctd_position_analysis_seconds_bucket{le=\"%g\"} %d\n", bound, m.buckets[i])
+	}
+	fmt.Fprintf(w, "ctd_position_analysis_seconds_bucket{le=\"+Inf\"} %d\n", m.positions)
+	fmt.Fprintf(w, "ctd_position_analysis_seconds_sum %g\n", m.seconds)
+	fmt.Fprintf(w, "ctd_position_analysis_seconds_count %d\n", m.positions)
+}
+
+// serveMetrics serves /metrics on addr until ctx is done, in the background
+// of a run reading input.
+func serveMetrics(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", stats)
+	srv := &http.Server{Addr: addr, Handler: mux, BaseContext: func(net.Listener) context.Context {
+		return ctx
+	}}
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+	go func() {
+		slog.Info("serving metrics", "addr", addr)
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			fatal(err.Error())
+		}
+	}()
+}
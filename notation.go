@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"github.com/notnil/chess"
+)
+
+// toSAN converts move, in the engine's UCI notation, to standard algebraic
+// notation (e.g. Nf3) in the position fen.
+func toSAN(fen string, move string) (string, error) {
+	line, err := sanLine(fen, []string{move})
+	if err != nil {
+		return "", err
+	}
+	return line[0], nil
+}
+
+// toUCI converts move, in UCI or SAN as stored with -notation, to the
+// engine's UCI notation in the position fen. SAN is matched without its check
+// and annotation marks, which EPD bm operands may or may not carry.
+func toUCI(fen string, move string) (string, error) {
+	opt, err := chess.FEN(fen)
+	if err != nil {
+		return "", err
+	}
+	pos := chess.NewGame(opt).Position()
+	san := strings.TrimRight(move, "+#!?")
+	for _, m := range pos.ValidMoves() {
+		uci := (chess.UCINotation{}).Encode(pos, m)
+		if uci == move || strings.TrimRight((chess.AlgebraicNotation{}).Encode(pos, m), "+#!?") == san {
+			return uci, nil
+		}
+	}
+	return "", errors.New("illegal move " + move + " in " + pos.String())
+}
+
+// legalMove reports whether move, in UCI notation, is legal in the position
+// fen. A position the board model can't read is given the benefit of the
+// doubt, leaving the move to the engine.
+func legalMove(fen string, move string) bool {
+	opt, err := chess.FEN(fen)
+	if err != nil {
+		return true
+	}
+	return findMove(chess.NewGame(opt).Position(), move) != nil
+}
+
+// sanLine converts the UCI moves played in turn from the position fen, such
+// as a principal variation, to SAN.
+func sanLine(fen string, moves []string) ([]string, error) {
+	opt, err := chess.FEN(fen)
+	if err != nil {
+		return nil, err
+	}
+	pos := chess.NewGame(opt).Position()
+	line := []string{}
+	for _, move := range moves {
+		found := findMove(pos, move)
+		if found == nil {
+			return nil, errors.New("illegal move " + move + " in " + pos.String())
+		}
+		line = append(line, (chess.AlgebraicNotation{}).Encode(pos, found))
+		pos = pos.Update(found)
+	}
+	return line, nil
+}
+
+// findMove returns the legal move of pos written move in UCI notation, or
+// nil if there is none.
+func findMove(pos *chess.Position, move string) *chess.Move {
+	for _, m := range pos.ValidMoves() {
+		if (chess.UCINotation{}).Encode(pos, m) == move {
+			return m
+		}
+	}
+	return nil
+}
+
+// movetext numbers the SAN moves of line, played from the position fen, as
+// in PGN: "13... Nf3 14. e4".
+func movetext(fen string, line []string) string {
+	fields := strings.Fields(fen)
+	move_num := 1
+	if len(fields) > 5 {
+		move_num, _ = strconv.Atoi(fields[5])
+	}
+	white := sideToMove(fen) == "w"
+	text := []string{}
+	for i, san := range line {
+		if white {
+			text = append(text, strconv.Itoa(move_num)+". "+san)
+		} else if i == 0 {
+			text = append(text, strconv.Itoa(move_num)+"... "+san)
+		} else {
+			text = append(text, san)
+		}
+		if !white {
+			move_num += 1
+		}
+		white = !white
+	}
+	return strings.Join(text, " ")
+}
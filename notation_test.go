@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestToUCI(t *testing.T) {
+	const ruy = "r1bqkbnr/pppp1ppp/2n5/4p3/4P3/5N2/PPPP1PPP/RNBQKB1R w KQkq - 2 3"
+	const check = "rnbqkbnr/ppppp1pp/5p2/8/4P3/8/PPPP1PPP/RNBQKBNR w KQkq - 0 2"
+	const mate = "rnbqkbnr/pppp1ppp/8/4p3/6P1/5P2/PPPPP2P/RNBQKBNR b KQkq - 0 2"
+	tests := []struct {
+		fen  string
+		move string
+		want string
+	}{
+		{ruy, "f1b5", "f1b5"},
+		{ruy, "Bb5", "f1b5"},
+		{ruy, "Bb5!", "f1b5"},
+		{ruy, "Nxe5?!", "f3e5"},
+		{check, "Qh5+", "d1h5"},
+		{check, "Qh5", "d1h5"},
+		{check, "Qh5+!?", "d1h5"},
+		{mate, "Qh4#", "d8h4"},
+		{mate, "Qh4", "d8h4"},
+	}
+	for _, test := range tests {
+		got, err := toUCI(test.fen, test.move)
+		if err != nil || got != test.want {
+			t.Errorf("toUCI(%s) = %q %v, want %q", test.move, got, err, test.want)
+		}
+	}
+	if got, err := toUCI(ruy, "Bb6"); err == nil {
+		t.Errorf("toUCI(Bb6) = %q, want an illegal move error", got)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// Recorder stores discovered tactics.
+type Recorder interface {
+	Record(t Tactic) error
+	// Flush stores any tactics held back by Record.
+	Flush() error
+	Close() error
+}
+
+// jsonRecorder writes each tactic as a single line of JSON.
+type jsonRecorder struct {
+	enc *json.Encoder
+}
+
+func newJSONRecorder(w io.Writer) *jsonRecorder {
+	return &jsonRecorder{json.NewEncoder(w)}
+}
+
+func (r *jsonRecorder) Record(t Tactic) error {
+	return r.enc.Encode(t)
+}
+
+func (r *jsonRecorder) Flush() error {
+	return nil
+}
+
+func (r *jsonRecorder) Close() error {
+	return nil
+}
+
+// csvRecorder writes each tactic as a line of CSV, after a header row naming
+// the positions table COLUMNS the fields mirror.
+type csvRecorder struct {
+	w *csv.Writer
+}
+
+func newCSVRecorder(w io.Writer) (*csvRecorder, error) {
+	r := &csvRecorder{csv.NewWriter(w)}
+	if err := r.w.Write(COLUMNS); err != nil {
+		return nil, err
+	}
+	return r, r.Flush()
+}
+
+func (r *csvRecorder) Record(t Tactic) error {
+	if err := r.w.Write([]string{t.Fen, t.Sm, strconv.Itoa(t.Cp), strconv.Itoa(t.Dm), t.Bm,
+		strconv.Itoa(t.Blunder), t.Pv, string(t.Kind), strconv.Itoa(t.Depth), strconv.FormatInt(t.Nodes, 10),
+		strconv.Itoa(t.MoveNum), t.Side, strconv.Itoa(t.Difficulty), t.EpdId, t.Engine, t.SearchLimit,
+		strconv.FormatBool(t.Tactical), strconv.FormatBool(t.Tablebase)}); err != nil {
+		return err
+	}
+	// written out line by line, as the JSON and PGN are
+	return r.Flush()
+}
+
+func (r *csvRecorder) Flush() error {
+	r.w.Flush()
+	return r.w.Error()
+}
+
+func (r *csvRecorder) Close() error {
+	return r.Flush()
+}
+
+// pgnRecorder writes each tactic as a PGN game starting from its position,
+// with the best line as the moves and the blunder in a comment, for loading
+// into chess GUIs.
+type pgnRecorder struct {
+	w io.Writer
+}
+
+func newPGNRecorder(w io.Writer) *pgnRecorder {
+	return &pgnRecorder{w}
+}
+
+func (r *pgnRecorder) Record(t Tactic) error {
+	lost := t.Blunder
+	if lost < 0 {
+		lost = -lost
+	}
+	comment := fmt.Sprintf("%s is a %s, losing %d", t.Sm, t.Kind, lost)
+	moves := "*"
+	if line, err := sanLine(t.Fen, strings.Fields(t.Pv)); err == nil && len(line) > 0 {
+		moves = movetext(t.Fen, line) + " *"
+	} else {
+		comment += ", best line " + t.Pv
+	}
+	_, err := fmt.Fprintf(r.w, "[Event \"Tactic\"]\n[Site \"?\"]\n[Date \"????.??.??\"]\n[Round \"?\"]\n"+
+		"[White \"?\"]\n[Black \"?\"]\n[Result \"*\"]\n[SetUp \"1\"]\n[FEN \"%s\"]\n\n{%s} %s\n\n",
+		t.Fen, comment, moves)
+	return err
+}
+
+func (r *pgnRecorder) Flush() error {
+	return nil
+}
+
+func (r *pgnRecorder) Close() error {
+	return nil
+}
+
+// countRecorder discards the tactics, which are only counted in the end of
+// run summary.
+type countRecorder struct{}
+
+func (r countRecorder) Record(t Tactic) error {
+	return nil
+}
+
+func (r countRecorder) Flush() error {
+	return nil
+}
+
+func (r countRecorder) Close() error {
+	return nil
+}
+
+// dryRunRecorder only logs the tactics it would have recorded.
+type dryRunRecorder struct{}
+
+func (r dryRunRecorder) Record(t Tactic) error {
+	slog.Info("would insert", "fen", t.Fen, "sm", t.Sm, "cp", t.Cp, "dm", t.Dm, "bm", t.Bm, "blunder", t.Blunder)
+	return nil
+}
+
+func (r dryRunRecorder) Flush() error {
+	return nil
+}
+
+func (r dryRunRecorder) Close() error {
+	return nil
+}
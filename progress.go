@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"time"
+	"github.com/atinm/chess_tactics_discovery/tactics"
+)
+
+// PROGRESS_WINDOW is the number of recent games the ETA's rate is averaged
+// over.
+const PROGRESS_WINDOW = 20
+
+// progressMeter prints the number of games analyzed and, when the number of
+// input records is known, the percentage done and estimated time remaining.
+type progressMeter struct {
+	w io.Writer
+	// total is the number of input records, or 0 if unknown.
+	total int
+	games int
+	// done is the number of input records analyzed or skipped.
+	done int
+	// samples holds the time and done count of recent games, oldest first.
+	samples []progressSample
+}
+
+type progressSample struct {
+	at   time.Time
+	done int
+}
+
+func newProgressMeter(w io.Writer, total int, skip int) *progressMeter {
+	p := &progressMeter{w: w, total: total, done: skip}
+	p.samples = append(p.samples, progressSample{time.Now(), skip})
+	return p
+}
+
+// game records that another game of records input records has been analyzed
+// and updates the progress line.
+func (p *progressMeter) game(records int) {
+	p.games += 1
+	p.done += records
+	p.samples = append(p.samples, progressSample{time.Now(), p.done})
+	if len(p.samples) > PROGRESS_WINDOW+1 {
+		p.samples = p.samples[1:]
+	}
+	if p.total == 0 {
+		fmt.Fprintf(p.w, "Games: %d\r", p.games)
+		return
+	}
+
+	percent := 100 * float64(p.done) / float64(p.total)
+	oldest, newest := p.samples[0], p.samples[len(p.samples)-1]
+	eta := "?"
+	if newest.done > oldest.done {
+		perRecord := newest.at.Sub(oldest.at) / time.Duration(newest.done-oldest.done)
+		eta = (perRecord * time.Duration(p.total-p.done)).Round(time.Second).String()
+	}
+	fmt.Fprintf(p.w, "Games: %d  %.1f%%  ETA %s    \r", p.games, percent, eta)
+}
+
+// countRecords returns the number of lines in the named files, skipping any
+// that can't be read.
+func countRecords(names []string) int {
+	total := 0
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			continue
+		}
+		r, err := gunzip(f)
+		if err != nil {
+			f.Close()
+			continue
+		}
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), tactics.MAX_LINE)
+		for scanner.Scan() {
+			total += 1
+		}
+		f.Close()
+	}
+	return total
+}
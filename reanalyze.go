@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"strings"
+	"github.com/atinm/chess_tactics_discovery/tactics"
+)
+
+// storedTactic is a row of the positions table to reanalyze.
+type storedTactic struct {
+	id  int64
+	fen string
+	sm  string
+}
+
+// reanalysis is the outcome of searching a stored tactic again: its new
+// scores, and whether it still holds up.
+type reanalysis struct {
+	id      int64
+	tactic  Tactic
+	keep    bool
+	// skipped is set when the engine gave no score, leaving the row as it was.
+	skipped bool
+	err     error
+}
+
+// reanalyze searches every tactic stored in table again with engines, under
+// settings, updating the scores of those that still hold up and deleting the
+// rest. The blunder column is left alone, as the position before it isn't
+// stored. It returns the number of rows kept and deleted, stopping early,
+// with the rows not reached left as they were, once ctx is done.
+func reanalyze(ctx context.Context, db *sql.DB, backend string, table string, engines []*tactics.Engine, settings Settings) (int, int, error) {
+	// read every row first, sqlite can't update a table being read
+	rows, err := db.Query("SELECT id, fen, sm FROM " + table + " ORDER BY id")
+	if err != nil {
+		return 0, 0, err
+	}
+	stored := []storedTactic{}
+	for rows.Next() {
+		var t storedTactic
+		if err := rows.Scan(&t.id, &t.fen, &t.sm); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		stored = append(stored, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	slog.Info("reanalyzing", "table", table, "rows", len(stored))
+
+	update, err := db.Prepare("UPDATE " + table + " SET cp = " + placeholder(backend, 1) +
+		", dm = " + placeholder(backend, 2) + ", bm = " + placeholder(backend, 3) +
+		", pv = " + placeholder(backend, 4) + ", kind = " + placeholder(backend, 5) +
+		", depth = " + placeholder(backend, 6) + ", nodes = " + placeholder(backend, 7) +
+		", difficulty = " + placeholder(backend, 8) + ", engine = " + placeholder(backend, 9) +
+		", search_limit = " + placeholder(backend, 10) + ", tactical = " + placeholder(backend, 11) +
+		", tablebase = " + placeholder(backend, 12) + " WHERE id = " + placeholder(backend, 13))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer update.Close()
+	remove, err := db.Prepare("DELETE FROM " + table + " WHERE id = " + placeholder(backend, 1))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer remove.Close()
+
+	jobs := make(chan storedTactic)
+	results := make(chan reanalysis)
+	for _, e := range engines {
+		go func(e *tactics.Engine) {
+			for t := range jobs {
+				results <- reanalyzeTactic(ctx, e, t, settings)
+			}
+		}(e)
+	}
+	go func() {
+		for _, t := range stored {
+			jobs <- t
+		}
+		close(jobs)
+	}()
+
+	kept, deleted := 0, 0
+	for range stored {
+		r := <-results
+		if r.err != nil && ctx.Err() != nil {
+			return kept, deleted, nil
+		}
+		if r.err != nil {
+			return kept, deleted, r.err
+		}
+		if r.skipped {
+			continue
+		}
+		if !r.keep {
+			if _, err := remove.Exec(r.id); err != nil {
+				return kept, deleted, err
+			}
+			deleted += 1
+			continue
+		}
+		t := r.tactic
+		if _, err := update.Exec(t.Cp, t.Dm, t.Bm, t.Pv, t.Kind, t.Depth, t.Nodes, t.Difficulty, t.Engine, t.SearchLimit, t.Tactical, t.Tablebase, r.id); err != nil {
+			return kept, deleted, err
+		}
+		kept += 1
+	}
+	return kept, deleted, nil
+}
+
+// reanalyzeTactic searches the played and best moves of stored again with e.
+// The tactic holds up when the best move is still a different one, at least
+// settings.MinAdvantage better or a mate, or escapes a mate the played move
+// walks into, its kind is one of settings.Kinds, it is still forced by
+// settings.ForcingThreshold and, with settings.TacticalOnly, its best line
+// is tactical.
+func reanalyzeTactic(ctx context.Context, e Analyzer, stored storedTactic, settings Settings) reanalysis {
+	res := reanalysis{id: stored.id}
+	sm, err := toUCI(stored.fen, stored.sm)
+	if err != nil {
+		// leave it to the engine, e.g. Chess960 castling
+		sm = stored.sm
+	}
+	_, smlines, err := e.Eval(ctx, stored.fen, []string{sm}, settings.Limit)
+	if err == nil {
+		var bm string
+		var bmlines []tactics.EngineInfo
+		bm, bmlines, err = e.Eval(ctx, stored.fen, nil, settings.Limit)
+		if err == nil {
+			res.keep, res.tactic = recheck(stored.fen, sm, smlines[0], bm, bmlines, settings)
+		}
+	}
+	if err == tactics.ErrNoScore {
+		slog.Warn("leaving tactic as it was", "id", stored.id, "fen", stored.fen, "err", err)
+		res.skipped = true
+		return res
+	}
+	if err == tactics.ErrNoMove {
+		slog.Warn("deleting tactic", "id", stored.id, "fen", stored.fen, "err", err)
+		return res
+	}
+	res.err = err
+	return res
+}
+
+// recheck judges the fresh scores of the played move sm and the best move bm
+// from the position fen, returning whether the tactic holds up and its new
+// columns.
+func recheck(fen string, sm string, smline tactics.EngineInfo, bm string, bmlines []tactics.EngineInfo, settings Settings) (bool, Tactic) {
+	smcp, smdm := smline.Cp, smline.Mate
+	bmcp, bmdm := bmlines[0].Cp, bmlines[0].Mate
+	kind := tactics.Classify(smcp, smdm, bmcp, bmdm, settings.Thresholds)
+	keep := bm != sm && (bmcp - smcp >= settings.MinAdvantage || tactics.MatesIn(bmdm, settings.MaxMateIn) ||
+		(tactics.MatedIn(smdm, settings.MaxMateIn) && !tactics.MatedIn(bmdm, settings.MaxMateIn)))
+	if len(settings.Kinds) > 0 && !settings.Kinds[kind] {
+		keep = false
+	}
+	tactical := tactics.MatesIn(bmdm, settings.MaxMateIn) || tacticalLine(fen, bmlines[0].Pv)
+	if settings.TacticalOnly && !tactical {
+		keep = false
+	}
+	if !forced(bmlines, settings.ForcingThreshold) {
+		keep = false
+	}
+	sign := 1
+	if sideToMove(fen) == "b" {
+		sign = -1
+	}
+	depth := smline.Depth
+	if bmlines[0].Depth < depth {
+		depth = bmlines[0].Depth
+	}
+	bmout := bm
+	if settings.Notation == "san" {
+		bmout = sanOrUCI(fen, bm)
+	}
+	return keep, Tactic{
+		Fen:         fen,
+		Cp:          sign * smcp,
+		Dm:          sign * smdm,
+		Bm:          bmout,
+		Pv:          storedPv(bmlines[0].Pv, settings.PvLength),
+		Kind:        kind,
+		Depth:       depth,
+		Nodes:       smline.Nodes + bmlines[0].Nodes,
+		Difficulty:  difficulty(fen, bmlines),
+		Engine:      settings.Engine,
+		SearchLimit: strings.Join(settings.Limit, " "),
+		Tactical:    tactical,
+		Tablebase:   smline.Tbhits > 0 || bmlines[0].Tbhits > 0,
+	}
+}
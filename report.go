@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+	"github.com/atinm/chess_tactics_discovery/tactics"
+)
+
+// report accumulates the totals printed at the end of a run.
+type report struct {
+	// engine names the engine that ran the searches.
+	engine     string
+	games      int
+	positions  int
+	found      int
+	invalid    int
+	illegal    int
+	noScore    int
+	repeated   int
+	known      int
+	duplicates int
+	// unverified counts the tactics the -verify-engine turned down.
+	unverified int
+	// failed counts the tactics the database would not store.
+	failed int
+	// kinds counts the tactics found of each Kind.
+	kinds map[tactics.Kind]int
+	// searches is the number of engine searches, engineTime the time the
+	// engine reported spending on them and depth their total depth.
+	searches   int
+	engineTime time.Duration
+	depth      int
+	// annotated and agreed count the EPD bm operations checked against the
+	// engine and those it agreed with.
+	annotated int
+	agreed    int
+}
+
+func newReport() *report {
+	return &report{kinds: map[tactics.Kind]int{}}
+}
+
+// add counts the positions, tactics and searches of res. Only games analyzed
+// to the end are counted in games.
+func (r *report) add(res Result) {
+	if !res.Interrupted {
+		r.games += 1
+	}
+	r.positions += res.Positions
+	r.invalid += res.Invalid
+	r.illegal += res.Illegal
+	r.noScore += res.NoScore
+	r.repeated += res.Repetitions
+	r.known += res.Known
+	r.unverified += res.Unverified
+	r.found += len(res.Tactics)
+	for _, t := range res.Tactics {
+		r.kinds[t.Kind] += 1
+	}
+	r.searches += res.Searches
+	r.engineTime += res.EngineTime
+	r.depth += res.Depth
+	r.annotated += res.Annotated
+	r.agreed += res.Agreed
+}
+
+// write prints the report to w.
+func (r *report) write(w io.Writer) {
+	fmt.Fprintf(w, "Analyzed %d positions in %d games, found %d tactics\n", r.positions, r.games, r.found)
+	for _, kind := range tactics.KINDS {
+		if r.kinds[kind] > 0 {
+			fmt.Fprintf(w, "  %-20s %d\n", kind, r.kinds[kind])
+		}
+	}
+	if r.engine != "" {
+		fmt.Fprintf(w, "Engine %s\n", r.engine)
+	}
+	if r.searches > 0 {
+		fmt.Fprintf(w, "Engine time %s over %d searches, average depth %.1f\n",
+			r.engineTime.Round(time.Millisecond), r.searches, float64(r.depth)/float64(r.searches))
+	}
+	if r.annotated > 0 {
+		fmt.Fprintf(w, "Engine agreed with %d of %d EPD best moves\n", r.agreed, r.annotated)
+	}
+	if r.invalid > 0 {
+		fmt.Fprintf(w, "Skipped %d positions with invalid FENs\n", r.invalid)
+	}
+	if r.illegal > 0 {
+		fmt.Fprintf(w, "Skipped %d positions whose played move is illegal\n", r.illegal)
+	}
+	if r.noScore > 0 {
+		fmt.Fprintf(w, "Skipped %d positions the engine gave no score for\n", r.noScore)
+	}
+	if r.repeated > 0 {
+		fmt.Fprintf(w, "Skipped %d positions repeated within their game\n", r.repeated)
+	}
+	if r.known > 0 {
+		fmt.Fprintf(w, "Skipped %d positions analyzed by earlier runs\n", r.known)
+	}
+	if r.unverified > 0 {
+		fmt.Fprintf(w, "Dropped %d tactics the verify engine disagreed with\n", r.unverified)
+	}
+	if r.duplicates > 0 {
+		fmt.Fprintf(w, "Skipped %d tactics already recorded\n", r.duplicates)
+	}
+	if r.failed > 0 {
+		fmt.Fprintf(w, "Failed to record %d tactics, see the log for errors\n", r.failed)
+	}
+}
+
+// writeFile saves the report to the file name, replacing its contents.
+func (r *report) writeFile(name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	r.write(f)
+	return f.Close()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+	"github.com/atinm/chess_tactics_discovery/tactics"
+)
+
+// analyzeRequest is the body of a POST to /analyze. Move is optional.
+type analyzeRequest struct {
+	Fen  string `json:"fen"`
+	Move string `json:"move"`
+}
+
+// analyzeResponse holds the score of the requested move, or of the best move
+// when none was given, along with the engine's best move and line, all from
+// the side to move's point of view. Kind is set when the requested move gives
+// away enough against the best one to make the position a tactic.
+type analyzeResponse struct {
+	Cp       int          `json:"cp"`
+	Mate     int          `json:"mate"`
+	BestMove string       `json:"bestmove"`
+	Pv       []string     `json:"pv"`
+	Depth    int          `json:"depth"`
+	Kind     tactics.Kind `json:"kind,omitempty"`
+}
+
+// server answers /analyze requests using a pool of running engines, so each
+// query is spared the engine's startup.
+type server struct {
+	pool     chan *tactics.Engine
+	settings Settings
+}
+
+// serve listens on addr, analyzing positions with engines until the server
+// fails or ctx is done, which also cancels the searches in progress.
+func serve(ctx context.Context, addr string, engines []*tactics.Engine, settings Settings) error {
+	s := &server{pool: make(chan *tactics.Engine, len(engines)), settings: settings}
+	for _, e := range engines {
+		s.pool <- e
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/analyze", s.analyze)
+	mux.Handle("/metrics", stats)
+	srv := &http.Server{Addr: addr, Handler: mux, BaseContext: func(net.Listener) context.Context {
+		return ctx
+	}}
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+	slog.Info("serving", "addr", addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (s *server) analyze(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST a JSON {fen, move} body", http.StatusMethodNotAllowed)
+		return
+	}
+	var req analyzeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Fen = tactics.NormalizeFEN(req.Fen)
+	if err := checkFEN(req.Fen, s.settings); err != nil {
+		http.Error(w, "bad fen: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Move != "" && !s.settings.Chess960 && s.settings.Variant == "" && !legalMove(req.Fen, req.Move) {
+		http.Error(w, "illegal move "+req.Move, http.StatusBadRequest)
+		return
+	}
+
+	e := <-s.pool
+	defer func() {
+		s.pool <- e
+	}()
+	// a client that hangs up cancels the search
+	start := time.Now()
+	bm, best, err := e.Eval(r.Context(), req.Fen, nil, s.settings.Limit)
+	var score tactics.EngineInfo
+	if err == nil {
+		score = best[0]
+	}
+	if err == nil && req.Move != "" && req.Move != bm {
+		var lines []tactics.EngineInfo
+		_, lines, err = e.Eval(r.Context(), req.Fen, []string{req.Move}, s.settings.Limit)
+		if err == nil {
+			score = lines[0]
+		}
+	}
+	if err == tactics.ErrNoMove || err == tactics.ErrNoScore {
+		stats.failed()
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if r.Context().Err() != nil {
+		// the client hung up or the server is shutting down
+		return
+	}
+	if err != nil {
+		slog.Error("analyzing", "fen", req.Fen, "err", err)
+		stats.failed()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	stats.position(time.Since(start))
+	// the move is judged as analyzeGame judges one, against the best move's
+	// score in place of the side's previous one
+	var kind tactics.Kind
+	blunder := tactics.DetectBlunder(best[0], score, s.settings.Thresholds)
+	mateMissable := blunder == 0 && score.Mate <= 0 && tactics.MatesIn(best[0].Mate, s.settings.MaxMateIn)
+	found := mateMissable || (blunder > 0 && (best[0].Cp - score.Cp >= s.settings.MinAdvantage || tactics.MatesIn(best[0].Mate, s.settings.MaxMateIn)))
+	if req.Move != "" && req.Move != bm && found {
+		kind = tactics.Classify(score.Cp, score.Mate, best[0].Cp, best[0].Mate, s.settings.Thresholds)
+		stats.tactic(kind)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(analyzeResponse{Cp: score.Cp, Mate: score.Mate, BestMove: bm, Pv: best[0].Pv, Depth: score.Depth, Kind: kind})
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// SQLITE_SCHEMA and POSTGRES_SCHEMA create the table named by their %[1]s,
+// with a unique index on fen so that a position already stored is rejected
+// as a duplicate.
+const SQLITE_SCHEMA = `CREATE TABLE IF NOT EXISTS %[1]s (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	fen VARCHAR(1024) NOT NULL,
+	sm VARCHAR(10) NOT NULL,
+	cp INT,
+	dm INT,
+	bm VARCHAR(10),
+	blunder INT,
+	pv VARCHAR(1024),
+	kind VARCHAR(20),
+	depth INT,
+	nodes BIGINT,
+	move_num INT,
+	side CHAR(1),
+	difficulty INT,
+	epd_id VARCHAR(255),
+	engine VARCHAR(64),
+	search_limit VARCHAR(32),
+	tactical BOOLEAN,
+	tablebase BOOLEAN
+);
+CREATE UNIQUE INDEX IF NOT EXISTS %[1]s_fen ON %[1]s(fen);`
+
+const POSTGRES_SCHEMA = `CREATE TABLE IF NOT EXISTS %[1]s (
+	id BIGSERIAL PRIMARY KEY,
+	fen VARCHAR(1024) NOT NULL,
+	sm VARCHAR(10) NOT NULL,
+	cp INTEGER,
+	dm INTEGER,
+	bm VARCHAR(10),
+	blunder INTEGER,
+	pv VARCHAR(1024),
+	kind VARCHAR(20),
+	depth INTEGER,
+	nodes BIGINT,
+	move_num INTEGER,
+	side CHAR(1),
+	difficulty INTEGER,
+	epd_id VARCHAR(255),
+	engine VARCHAR(64),
+	search_limit VARCHAR(32),
+	tactical BOOLEAN,
+	tablebase BOOLEAN
+);
+CREATE UNIQUE INDEX IF NOT EXISTS %[1]s_fen ON %[1]s(fen);`
+
+// ANALYZED_SCHEMA creates the table, named by its %[1]s, of the positions
+// analyzed by runs with -skip-analyzed, keyed by their first four FEN fields.
+const ANALYZED_SCHEMA = `CREATE TABLE IF NOT EXISTS %[1]s (
+	position VARCHAR(100) NOT NULL PRIMARY KEY
+)`
+
+// ANALYZED_BATCH is how many analyzed positions are held back before they are
+// flushed, even with no tactics pending.
+const ANALYZED_BATCH = 10000
+
+// DB_RETRIES is how many times a batch is retried after a connection error,
+// waiting DB_BACKOFF before the first retry and twice as long before each
+// one after.
+const DB_RETRIES = 5
+const DB_BACKOFF = 500 * time.Millisecond
+
+// COLUMNS are the positions columns written for each tactic, in the order
+// dbRecorder passes them.
+var COLUMNS = []string{"fen", "sm", "cp", "dm", "bm", "blunder", "pv", "kind", "depth", "nodes", "move_num", "side", "difficulty", "epd_id", "engine", "search_limit", "tactical", "tablebase"}
+
+// validIdentifier reports whether name is safe to use unquoted as a table or
+// database name in SQL text.
+func validIdentifier(name string) bool {
+	reid := regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]{0,62}$")
+	return reid.MatchString(name)
+}
+
+// connectDB connects to database on backend (mysql, postgres or sqlite)
+// using dsn, without creating any table. When dsn is empty the mysql and
+// postgres connections are configured from the SQLUSER, SQLPASS, SQLIP and
+// SQLPORT environment variables, and sqlite opens sqliteFile.
+func connectDB(backend string, dsn string, sqliteFile string, database string) (*sql.DB, error) {
+	if !validIdentifier(database) {
+		return nil, errors.New("Bad database name: " + database)
+	}
+	switch backend {
+	case "mysql":
+		if dsn == "" {
+			dsn = os.ExpandEnv("${SQLUSER}:${SQLPASS}@tcp(${SQLIP}:${SQLPORT})/" + database)
+		}
+		return sql.Open("mysql", dsn)
+
+	case "postgres":
+		if dsn == "" {
+			dsn = os.ExpandEnv("postgres://${SQLUSER}:${SQLPASS}@${SQLIP}:${SQLPORT}/" + database + "?sslmode=disable")
+		}
+		return sql.Open("postgres", dsn)
+
+	case "sqlite":
+		if dsn == "" {
+			dsn = sqliteFile
+		}
+		return sql.Open("sqlite", dsn)
+
+	default:
+		return nil, errors.New("Unrecognized db: " + backend)
+	}
+}
+
+// openDB connects to database as connectDB does, and for postgres and sqlite
+// creates table if it doesn't exist.
+func openDB(backend string, dsn string, sqliteFile string, database string, table string) (*sql.DB, error) {
+	if !validIdentifier(table) {
+		return nil, errors.New("Bad table name: " + table)
+	}
+	db, err := connectDB(backend, dsn, sqliteFile, database)
+	if err != nil {
+		return nil, err
+	}
+	schema := ""
+	switch backend {
+	case "postgres":
+		schema = POSTGRES_SCHEMA
+	case "sqlite":
+		schema = SQLITE_SCHEMA
+	}
+	if schema != "" {
+		if _, err := db.Exec(fmt.Sprintf(schema, table)); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// isDuplicate reports whether err is a unique key violation, i.e. the row is
+// already in the database.
+func isDuplicate(err error) bool {
+	var merr *mysql.MySQLError
+	if errors.As(err, &merr) {
+		return merr.Number == 1062
+	}
+	var perr *pq.Error
+	if errors.As(err, &perr) {
+		return perr.Code == "23505"
+	}
+	var serr *sqlite.Error
+	if errors.As(err, &serr) {
+		return serr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE || serr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+	}
+	return false
+}
+
+// isTransient reports whether err is a lost or busy connection, which is
+// worth retrying, rather than a problem with the row itself.
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) {
+		return true
+	}
+	var perr *pq.Error
+	if errors.As(err, &perr) {
+		// connection exceptions and operator intervention, e.g. shutdown
+		return strings.HasPrefix(string(perr.Code), "08") || strings.HasPrefix(string(perr.Code), "57P")
+	}
+	var serr *sqlite.Error
+	if errors.As(err, &serr) {
+		return serr.Code() == sqlite3.SQLITE_BUSY || serr.Code() == sqlite3.SQLITE_LOCKED
+	}
+	return false
+}
+
+// dbRecorder inserts tactics into a positions table, batchSize rows to a
+// transaction.
+type dbRecorder struct {
+	db        *sql.DB
+	backend   string
+	stmt      *sql.Stmt
+	batchSize int
+	pending   []Tactic
+	// duplicates counts the rows the database rejected as already present,
+	// and failed those it rejected for any other reason.
+	duplicates int
+	failed     int
+	// mark, when set, records the analyzed positions in analyzed along with
+	// the tactics.
+	mark     *sql.Stmt
+	analyzed []string
+}
+
+// placeholder returns the n'th (from 1) query parameter for backend: $n on
+// postgres and ? elsewhere.
+func placeholder(backend string, n int) string {
+	if backend == "postgres" {
+		return "$" + strconv.Itoa(n)
+	}
+	return "?"
+}
+
+// insertQuery returns the INSERT statement into table for backend.
+func insertQuery(backend string, table string) string {
+	placeholders := make([]string, len(COLUMNS))
+	for i := range placeholders {
+		placeholders[i] = placeholder(backend, i+1)
+	}
+	return "INSERT INTO " + table + "(" + strings.Join(COLUMNS, ", ") + ") VALUES(" + strings.Join(placeholders, ", ") + ")"
+}
+
+func newDBRecorder(db *sql.DB, backend string, table string, batchSize int) (*dbRecorder, error) {
+	stmt, err := db.Prepare(insertQuery(backend, table))
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &dbRecorder{db: db, backend: backend, stmt: stmt, batchSize: batchSize}, nil
+}
+
+// loadAnalyzed creates the table of analyzed positions named table, if
+// needed, and returns the positions already in it.
+func loadAnalyzed(db *sql.DB, table string) (map[string]bool, error) {
+	if _, err := db.Exec(fmt.Sprintf(ANALYZED_SCHEMA, table)); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT position FROM " + table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	analyzed := map[string]bool{}
+	for rows.Next() {
+		var position string
+		if err := rows.Scan(&position); err != nil {
+			return nil, err
+		}
+		analyzed[position] = true
+	}
+	return analyzed, rows.Err()
+}
+
+// trackAnalyzed makes Flush also store the positions passed to Analyzed in
+// the table named table, as made by loadAnalyzed.
+func (r *dbRecorder) trackAnalyzed(table string) error {
+	query := "INSERT INTO " + table + "(position) VALUES(" + placeholder(r.backend, 1) + ")"
+	switch r.backend {
+	case "mysql":
+		query = "INSERT IGNORE" + strings.TrimPrefix(query, "INSERT")
+	case "sqlite":
+		query = "INSERT OR IGNORE" + strings.TrimPrefix(query, "INSERT")
+	case "postgres":
+		query += " ON CONFLICT DO NOTHING"
+	}
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return err
+	}
+	r.mark = stmt
+	return nil
+}
+
+// Analyzed holds positions back to be stored by the next Flush, once the
+// tactics found in them are.
+func (r *dbRecorder) Analyzed(positions []string) error {
+	if r.mark == nil {
+		return nil
+	}
+	r.analyzed = append(r.analyzed, positions...)
+	if len(r.analyzed) >= ANALYZED_BATCH {
+		return r.Flush()
+	}
+	return nil
+}
+
+func (r *dbRecorder) Record(t Tactic) error {
+	r.pending = append(r.pending, t)
+	if len(r.pending) >= r.batchSize {
+		return r.Flush()
+	}
+	return nil
+}
+
+// Flush inserts the pending tactics in a single transaction. When the
+// connection fails part way the transaction is retried from the start, up to
+// DB_RETRIES times with the wait doubling from DB_BACKOFF; database/sql
+// reconnects as needed.
+func (r *dbRecorder) Flush() error {
+	if len(r.pending) == 0 && len(r.analyzed) == 0 {
+		return nil
+	}
+	backoff := DB_BACKOFF
+	for retries := 0; ; retries++ {
+		duplicates, failed, err := r.insert()
+		if err == nil {
+			r.duplicates += duplicates
+			r.failed += failed
+			r.pending = r.pending[:0]
+			r.analyzed = r.analyzed[:0]
+			return nil
+		}
+		if !isTransient(err) || retries >= DB_RETRIES {
+			return err
+		}
+		slog.Warn("database error, retrying", "backoff", backoff, "err", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// insert runs one transaction inserting the pending tactics, returning how
+// many were duplicates and how many failed for reasons other than the
+// connection. Connection errors abort the transaction and are returned; on
+// postgres a row rejected for any other reason is rolled back on its own.
+func (r *dbRecorder) insert() (int, int, error) {
+	duplicates, failed := 0, 0
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	stmt := tx.Stmt(r.stmt)
+	// a failed statement aborts the whole of a postgres transaction, so each
+	// row is inserted under a savepoint that a rejected one rolls back to
+	savepoint := r.backend == "postgres"
+	for _, t := range r.pending {
+		slog.Debug("inserting", "fen", t.Fen, "sm", t.Sm, "cp", t.Cp, "dm", t.Dm, "bm", t.Bm, "blunder", t.Blunder)
+		
+		if savepoint {
+			if _, err := tx.Exec("SAVEPOINT tactic"); err != nil {
+				tx.Rollback()
+				return 0, 0, err
+			}
+		}
+		res, err := stmt.Exec(t.Fen, t.Sm, t.Cp, t.Dm, t.Bm, t.Blunder, t.Pv, t.Kind, t.Depth, t.Nodes, t.MoveNum, t.Side, t.Difficulty, t.EpdId, t.Engine, t.SearchLimit, t.Tactical, t.Tablebase)
+		if err != nil && savepoint && !isTransient(err) {
+			if _, err := tx.Exec("ROLLBACK TO SAVEPOINT tactic"); err != nil {
+				tx.Rollback()
+				return 0, 0, err
+			}
+		}
+		if isDuplicate(err) {
+			duplicates += 1
+			continue
+		}
+		if isTransient(err) {
+			tx.Rollback()
+			return 0, 0, err
+		}
+		if err != nil {
+			slog.Error("inserting", "fen", t.Fen, "err", err)
+			failed += 1
+			continue
+		}
+		rowCnt, err := res.RowsAffected()
+		if err != nil {
+			tx.Rollback()
+			return 0, 0, err
+		}
+		if r.backend == "postgres" {
+			// lib/pq has no LastInsertId
+			slog.Debug("inserted", "affected", rowCnt)
+			if _, err := tx.Exec("RELEASE SAVEPOINT tactic"); err != nil {
+				tx.Rollback()
+				return 0, 0, err
+			}
+			continue
+		}
+		lastId, err := res.LastInsertId()
+		if err != nil {
+			tx.Rollback()
+			return 0, 0, err
+		}
+		
+		slog.Debug("inserted", "id", lastId, "affected", rowCnt)
+	}
+	if len(r.analyzed) > 0 {
+		mark := tx.Stmt(r.mark)
+		for _, position := range r.analyzed {
+			if _, err := mark.Exec(position); err != nil {
+				tx.Rollback()
+				return 0, 0, err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return duplicates, failed, nil
+}
+
+// Close inserts any pending tactics and closes the database.
+func (r *dbRecorder) Close() error {
+	err := r.Flush()
+	r.stmt.Close()
+	if r.mark != nil {
+		r.mark.Close()
+	}
+	if cerr := r.db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
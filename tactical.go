@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/notnil/chess"
+)
+
+// TACTICAL_PLIES is how far into the best line a tactic must win
+// TACTICAL_GAIN centipawns of material, counted after the opponent's replies.
+const TACTICAL_PLIES = 6
+const TACTICAL_GAIN = 200
+
+// PIECE_VALUES are the material values, in centipawns, tacticalLine counts.
+var PIECE_VALUES = map[chess.PieceType]int{
+	chess.Pawn:   100,
+	chess.Knight: 300,
+	chess.Bishop: 300,
+	chess.Rook:   500,
+	chess.Queen:  900,
+}
+
+// tacticalLine reports whether the UCI line pv, played from the position fen,
+// is a sharp one: it starts with a capture or check and wins the side to move
+// at least TACTICAL_GAIN centipawns of material within TACTICAL_PLIES.
+// Lines that can't be replayed are not tactical.
+func tacticalLine(fen string, pv []string) bool {
+	if len(pv) == 0 {
+		return false
+	}
+	opt, err := chess.FEN(fen)
+	if err != nil {
+		return false
+	}
+	pos := chess.NewGame(opt).Position()
+	mover := pos.Turn()
+	start := material(pos, mover)
+	gain := 0
+	for i, move := range pv {
+		if i >= TACTICAL_PLIES {
+			break
+		}
+		found := findMove(pos, move)
+		if found == nil {
+			return false
+		}
+		if i == 0 && !found.HasTag(chess.Capture) && !found.HasTag(chess.Check) {
+			return false
+		}
+		pos = pos.Update(found)
+		// count once the opponent has had the chance to recapture, or at
+		// the end of a line cut short
+		if i%2 == 1 || i == len(pv)-1 {
+			if g := material(pos, mover) - start; g > gain {
+				gain = g
+			}
+		}
+	}
+	return gain >= TACTICAL_GAIN
+}
+
+// material returns side's material less its opponent's in pos.
+func material(pos *chess.Position, side chess.Color) int {
+	total := 0
+	for _, piece := range pos.Board().SquareMap() {
+		if piece.Color() == side {
+			total += PIECE_VALUES[piece.Type()]
+		} else {
+			total -= PIECE_VALUES[piece.Type()]
+		}
+	}
+	return total
+}
@@ -0,0 +1,54 @@
+package tactics
+
+import (
+	"container/list"
+	"sync"
+)
+
+// EvalCache remembers the results of Eval, shared by all engines. When size is
+// non-zero it holds at most size results, dropping the least recently used.
+type EvalCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	// order holds the cacheEntry values, most recently used first.
+	order *list.List
+}
+
+type cacheEntry struct {
+	key   string
+	bm    string
+	lines []EngineInfo
+}
+
+func NewEvalCache(size int) *EvalCache {
+	return &EvalCache{size: size, entries: map[string]*list.Element{}, order: list.New()}
+}
+
+func (c *EvalCache) get(key string) (string, []EngineInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return "", nil, false
+	}
+	c.order.MoveToFront(elem)
+	entry := elem.Value.(*cacheEntry)
+	return entry.bm, entry.lines, true
+}
+
+func (c *EvalCache) put(key string, bm string, lines []EngineInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.order.MoveToFront(elem)
+		elem.Value = &cacheEntry{key, bm, lines}
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key, bm, lines})
+	if c.size > 0 && c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
@@ -0,0 +1,407 @@
+package tactics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/notnil/chess"
+)
+
+// CECP_MATE is the score CECP engines report mates from: CECP_MATE + N when
+// the side to move mates in N moves and -CECP_MATE - N when it is mated in N.
+const CECP_MATE = 100000
+
+// ErrIllegalMove is returned by Eval over CECP when a move to search isn't
+// legal in the position.
+var ErrIllegalMove = errors.New("illegal move")
+
+// rethinking matches a line of CECP thinking output: ply, score, time in
+// centiseconds and nodes, then the principal variation, possibly after more
+// statistics ended by a tab.
+var rethinking = regexp.MustCompile(`^\s*([0-9]+)\S*\s+(-?[0-9]+)\s+([0-9]+)\s+([0-9]+)(.*)$`)
+
+// CECP_FEATURES are the features the handshake accepts; the rest, san among
+// them, are rejected so the engine falls back to the protocol's defaults.
+var CECP_FEATURES = map[string]bool{"setboard": true, "ping": true, "usermove": true, "myname": true, "memory": true, "smp": true, "egt": true, "option": true, "done": true}
+
+// cecp speaks CECP, the xboard protocol, version 2. Searches run in analyze
+// mode and are ended with exit once the search limit is reached. CECP has no
+// searchmoves, so a move is scored by analyzing the position after it.
+type cecp struct {
+	e *Engine
+	// features holds the engine's replies to protover, e.g. setboard=1, and
+	// options the names of the options it offers.
+	features map[string]string
+	options  map[string]bool
+	pings    int
+}
+
+// send writes command to the engine.
+func (p *cecp) send(command string) error {
+	if Verbose {
+		slog.Debug("engine command", "cmd", command)
+	}
+	if _, err := io.WriteString(p.e.in, command+"\n"); err != nil {
+		return ErrEngineDied
+	}
+	return nil
+}
+
+// readLine returns the next line of engine output, as Engine.readLine does.
+func (p *cecp) readLine(ctx context.Context) (string, error) {
+	line, err := p.e.readLine(ctx)
+	if err == nil && Verbose {
+		slog.Debug("engine output", "line", line)
+	}
+	return line, err
+}
+
+func (p *cecp) handshake(ctx context.Context) error {
+	p.features, p.options = map[string]string{}, map[string]bool{}
+	if err := p.send("xboard"); err != nil {
+		return err
+	}
+	if err := p.send("protover 2"); err != nil {
+		return err
+	}
+	// read until the engine says it has sent all its features
+	for p.features["done"] != "1" {
+		line, err := p.readLine(ctx)
+		if err != nil {
+			return err
+		}
+		body, ok := strings.CutPrefix(line, "feature ")
+		if !ok {
+			continue
+		}
+		for _, feature := range parseFeatures(body) {
+			name, value := feature[0], feature[1]
+			p.features[name] = value
+			if name == "option" {
+				option, _, _ := strings.Cut(value, " -")
+				p.options[option] = true
+			}
+			reply := "rejected "
+			if CECP_FEATURES[name] {
+				reply = "accepted "
+			}
+			if err := p.send(reply + name); err != nil {
+				return err
+			}
+		}
+	}
+	// the searches need both to set up positions and wait for the engine
+	for _, feature := range []string{"setboard", "ping"} {
+		if p.features[feature] != "1" {
+			return errors.New("engine lacks the CECP " + feature + " feature")
+		}
+	}
+	// analyze is on unless the engine turns it off
+	if p.features["analyze"] == "0" {
+		return errors.New("engine lacks the CECP analyze feature")
+	}
+	p.e.Name = p.features["myname"]
+	return p.start()
+}
+
+// start readies the engine for a game it doesn't play a side of.
+func (p *cecp) start() error {
+	if err := p.send("new"); err != nil {
+		return err
+	}
+	if err := p.send("force"); err != nil {
+		return err
+	}
+	return p.send("post")
+}
+
+// setOption translates the UCI options set by Engine.Options to their CECP
+// commands. Options the engine didn't offer are left unset. Chess960 and
+// variants are refused, as their moves can't be read without a board model
+// that knows them.
+func (p *cecp) setOption(ctx context.Context, name string, value string) error {
+	switch {
+	case name == "Ponder" && value == "false":
+		return p.send("easy")
+	case name == "Ponder":
+		return p.send("hard")
+	case name == "Hash" && p.features["memory"] == "1":
+		return p.send("memory " + value)
+	case name == "Threads" && p.features["smp"] == "1":
+		return p.send("cores " + value)
+	case name == "UCI_Chess960" && value == "true", name == "UCI_Variant" && value != "":
+		return errors.New("Unsupported over CECP: " + name)
+	case name == "SyzygyPath" && strings.Contains(p.features["egt"], "syzygy"):
+		return p.send("egtpath syzygy " + value)
+	case p.options[name]:
+		return p.send("option " + name + "=" + value)
+	}
+	slog.Debug("engine has no such CECP option", "name", name)
+	return nil
+}
+
+// ready pings the engine and waits for its pong.
+func (p *cecp) ready(ctx context.Context) error {
+	p.pings += 1
+	pong := "pong " + strconv.Itoa(p.pings)
+	if err := p.send("ping " + strconv.Itoa(p.pings)); err != nil {
+		return err
+	}
+	for {
+		line, err := p.readLine(ctx)
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(line) == pong {
+			return nil
+		}
+	}
+}
+
+func (p *cecp) newGame(ctx context.Context) error {
+	return p.start()
+}
+
+// search analyzes fen, or with moves the position after each of them, and
+// returns the best. Its scores are from the side to move in fen.
+func (p *cecp) search(ctx context.Context, fen string, moves []string, limit []string) (string, []EngineInfo, error) {
+	if len(moves) == 0 {
+		return p.analyze(ctx, fen, "", limit)
+	}
+	bm, best := "", []EngineInfo{}
+	for _, move := range moves {
+		_, lines, err := p.analyze(ctx, fen, move, limit)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(lines) > 0 && (len(best) == 0 || Worth(lines[0]) > Worth(best[0])) {
+			bm, best = move, lines
+		}
+	}
+	return bm, best, nil
+}
+
+// analyze searches fen, after move when it is set, in analyze mode until the
+// UCI go arguments of limit are met, returning the last line of thinking
+// output from the side to move in fen.
+func (p *cecp) analyze(ctx context.Context, fen string, move string, limit []string) (string, []EngineInfo, error) {
+	fen = NormalizeFEN(fen)
+	// a FEN the board model can't read has its moves passed on unchecked
+	var pos *chess.Position
+	if opt, err := chess.FEN(fen); err == nil {
+		pos = chess.NewGame(opt).Position()
+		if len(pos.ValidMoves()) == 0 {
+			return "", nil, ErrNoMove
+		}
+	}
+	if move != "" && pos != nil {
+		found := cecpMove(pos, move)
+		if found == nil {
+			return "", nil, ErrIllegalMove
+		}
+		pos = pos.Update(found)
+		// there is nothing left to analyze once the game is over
+		switch pos.Status() {
+		case chess.Checkmate:
+			return move, []EngineInfo{{Move: move, Mate: 1, Pv: []string{move}}}, nil
+		case chess.Stalemate:
+			return move, []EngineInfo{{Move: move, Pv: []string{move}}}, nil
+		}
+	}
+
+	commands := []string{"force", "setboard " + fen}
+	if move != "" && p.features["usermove"] == "1" {
+		commands = append(commands, "usermove "+move)
+	} else if move != "" {
+		commands = append(commands, move)
+	}
+	for _, command := range append(commands, "analyze") {
+		if err := p.send(command); err != nil {
+			return "", nil, err
+		}
+	}
+
+	depth, nodes := 0, int64(0)
+	timed := ctx
+	for i := 0; i+1 < len(limit); i += 2 {
+		switch limit[i] {
+		case "depth":
+			depth, _ = strconv.Atoi(limit[i+1])
+		case "nodes":
+			nodes, _ = strconv.ParseInt(limit[i+1], 10, 64)
+		case "movetime":
+			ms, _ := strconv.Atoi(limit[i+1])
+			var cancel context.CancelFunc
+			timed, cancel = context.WithTimeout(ctx, time.Duration(ms)*time.Millisecond)
+			defer cancel()
+		}
+	}
+	var last *EngineInfo
+	for {
+		line, err := p.readLine(timed)
+		if err != nil && ctx.Err() == nil && timed.Err() != nil {
+			// movetime is up
+			break
+		}
+		if err != nil {
+			if err == ctx.Err() {
+				p.send("exit")
+				p.ready(context.Background())
+			}
+			return "", nil, err
+		}
+		info, ok := parseThinking(line, pos)
+		if !ok {
+			continue
+		}
+		last = &info
+		if (depth > 0 && info.Depth >= depth) || (nodes > 0 && info.Nodes >= nodes) {
+			break
+		}
+	}
+	// leave analyze mode, and wait for the engine to stop thinking aloud
+	if err := p.send("exit"); err != nil {
+		return "", nil, err
+	}
+	if err := p.ready(ctx); err != nil {
+		return "", nil, err
+	}
+	if last == nil {
+		return "", nil, nil
+	}
+	if move != "" {
+		return move, []EngineInfo{afterMove(move, *last)}, nil
+	}
+	return last.Move, []EngineInfo{*last}, nil
+}
+
+func (p *cecp) quit() error {
+	return p.send("quit")
+}
+
+// parseFeatures splits the body of a feature command into its name=value
+// pairs, unquoting the quoted values.
+func parseFeatures(body string) [][2]string {
+	features := [][2]string{}
+	for body = strings.TrimSpace(body); body != ""; body = strings.TrimSpace(body) {
+		name, rest, ok := strings.Cut(body, "=")
+		if !ok {
+			break
+		}
+		value := ""
+		if quoted, ok := strings.CutPrefix(rest, `"`); ok {
+			value, body, _ = strings.Cut(quoted, `"`)
+		} else if end := strings.IndexAny(rest, " \t"); end >= 0 {
+			value, body = rest[:end], rest[end:]
+		} else {
+			value, body = rest, ""
+		}
+		features = append(features, [2]string{name, value})
+	}
+	return features
+}
+
+// parseThinking reads a line of thinking output, a search of pos (nil when
+// it can't be modeled), reporting false for any other output.
+func parseThinking(line string, pos *chess.Position) (EngineInfo, bool) {
+	arr := rethinking.FindStringSubmatch(line)
+	if arr == nil {
+		return EngineInfo{}, false
+	}
+	info := EngineInfo{}
+	info.Depth, _ = strconv.Atoi(arr[1])
+	score, _ := strconv.Atoi(arr[2])
+	switch {
+	case score >= CECP_MATE:
+		info.Mate = score - CECP_MATE
+	case score <= -CECP_MATE:
+		info.Mate = score + CECP_MATE
+		info.Mated = info.Mate == 0
+	default:
+		info.Cp = score
+	}
+	centiseconds, _ := strconv.Atoi(arr[3])
+	info.Time = centiseconds * 10
+	info.Nodes, _ = strconv.ParseInt(arr[4], 10, 64)
+	if info.Time > 0 {
+		info.Nps = info.Nodes * 1000 / int64(info.Time)
+	}
+	pv := arr[5]
+	if stats, rest, ok := strings.Cut(pv, "\t"); ok {
+		// seldepth, speed and tbhits, as far as the engine reports them
+		if fields := strings.Fields(stats); len(fields) > 2 {
+			info.Tbhits, _ = strconv.ParseInt(fields[2], 10, 64)
+		}
+		pv = rest
+	}
+	info.Pv = pvMoves(pos, pv)
+	if len(info.Pv) > 0 {
+		info.Move = info.Pv[0]
+	}
+	return info, true
+}
+
+// pvMoves converts the principal variation of a thinking line, which engines
+// write in SAN or coordinate notation with move numbers among the moves, to
+// UCI moves played from pos. The line ends at the first move that isn't
+// legal. Without a board the coordinate moves are kept as they are.
+func pvMoves(pos *chess.Position, pv string) []string {
+	moves := []string{}
+	for _, token := range strings.Fields(pv) {
+		if strings.ContainsAny(token, "<{([") {
+			// comments and hash table markers end the moves
+			break
+		}
+		if dot := strings.LastIndex(token, "."); dot >= 0 {
+			// a move number, "12." or "12...", maybe run into its move
+			token = token[dot+1:]
+		}
+		token = strings.ReplaceAll(strings.TrimRight(token, "+#!?"), "0-0", "O-O")
+		if token == "" {
+			continue
+		}
+		if pos == nil {
+			moves = append(moves, token)
+			continue
+		}
+		found := cecpMove(pos, token)
+		if found == nil {
+			break
+		}
+		moves = append(moves, (chess.UCINotation{}).Encode(pos, found))
+		pos = pos.Update(found)
+	}
+	return moves
+}
+
+// cecpMove returns the legal move of pos written move in UCI or SAN, or nil
+// if there is none.
+func cecpMove(pos *chess.Position, move string) *chess.Move {
+	for _, m := range pos.ValidMoves() {
+		if (chess.UCINotation{}).Encode(pos, m) == move || strings.TrimRight((chess.AlgebraicNotation{}).Encode(pos, m), "+#") == move {
+			return m
+		}
+	}
+	return nil
+}
+
+// afterMove turns info, the analysis of the position after move, into the
+// score of move for the side playing it.
+func afterMove(move string, info EngineInfo) EngineInfo {
+	scored := info
+	scored.Move, scored.Cp, scored.Wdl = move, -info.Cp, nil
+	scored.Pv = append([]string{move}, info.Pv...)
+	switch {
+	case info.Mate < 0 || info.Mated:
+		// the reply is mated after it, one move more for the mover
+		scored.Mate, scored.Mated = -info.Mate+1, false
+	case info.Mate > 0:
+		scored.Mate = -info.Mate
+	}
+	return scored
+}
@@ -0,0 +1,290 @@
+package tactics
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"github.com/notnil/chess"
+)
+
+// fakeCECP attaches an Engine to an in-process xboard engine over io.Pipe. It
+// offers features in reply to protover, answers the first analyze with the
+// lines of searches[0], the next with searches[1], and so on, and sends every
+// command it gets to commands.
+func fakeCECP(t *testing.T, features string, options [][]string, searches ...[]string) (*Engine, chan string, error) {
+	t.Helper()
+	inr, inw := io.Pipe()
+	outr, outw := io.Pipe()
+	commands := make(chan string, 100)
+	go func() {
+		defer outw.Close()
+		received := bufio.NewScanner(inr)
+		reply := func(lines ...string) {
+			for _, line := range lines {
+				io.WriteString(outw, line+"\n")
+			}
+		}
+		for received.Scan() {
+			command := received.Text()
+			commands <- command
+			switch {
+			case command == "protover 2":
+				reply("feature "+features, "feature done=1")
+			case strings.HasPrefix(command, "ping "):
+				reply("pong " + strings.TrimPrefix(command, "ping "))
+			case command == "analyze":
+				if len(searches) == 0 {
+					t.Errorf("unexpected search")
+					continue
+				}
+				reply(searches[0]...)
+				searches = searches[1:]
+			case command == "quit":
+				return
+			}
+		}
+	}()
+	e := &Engine{Protocol: PROTOCOL_CECP, Options: options}
+	err := e.Attach(inw, outr)
+	t.Cleanup(func() {
+		if err == nil {
+			e.Close()
+		}
+		inw.Close()
+	})
+	return e, commands, err
+}
+
+// received returns the commands the fake engine has been sent so far.
+func received(commands chan string) []string {
+	sent := []string{}
+	for {
+		select {
+		case command := <-commands:
+			sent = append(sent, command)
+		default:
+			return sent
+		}
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	features := `ping=1 setboard=1 san=1 usermove=1 myname="FakeBoard 2.0" colors=0 option="Style -combo Solid /// Normal" memory=1`
+	e, commands, err := fakeCECP(t, features, [][]string{{"Style", "Normal"}, {"Hash", "64"}, {"Contempt", "10"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Name != "FakeBoard 2.0" {
+		t.Errorf("name = %q, want FakeBoard 2.0", e.Name)
+	}
+	sent := received(commands)
+	want := []string{
+		"accepted ping", "accepted setboard", "rejected san", "accepted usermove", "accepted myname",
+		"rejected colors", "accepted option", "accepted memory", "accepted done",
+		"new", "force", "post", "easy", "option Style=Normal", "memory 64", "ping 1",
+	}
+	if len(sent) < 2 || !reflect.DeepEqual(sent[2:], want) {
+		t.Errorf("commands = %q, want xboard, protover 2 then %q", sent, want)
+	}
+}
+
+func TestHandshakeRefused(t *testing.T) {
+	tests := []struct {
+		features string
+		want     string
+	}{
+		{"ping=1", "engine lacks the CECP setboard feature"},
+		{"setboard=1", "engine lacks the CECP ping feature"},
+		{"ping=1 setboard=1 analyze=0", "engine lacks the CECP analyze feature"},
+	}
+	for _, test := range tests {
+		_, _, err := fakeCECP(t, test.features, nil)
+		if err == nil || err.Error() != test.want {
+			t.Errorf("%s: err = %v, want %s", test.features, err, test.want)
+		}
+	}
+}
+
+func TestEvalCECP(t *testing.T) {
+	e, commands, err := fakeCECP(t, "ping=1 setboard=1 usermove=1", nil, []string{
+		"4 25 10 300 Bc4",
+		"12 60 100 2000 3. Bb5 a6",
+	}, []string{
+		"10 80 50 1000 Nxe5",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bm, lines, err := e.Eval(context.Background(), TEST_FEN, nil, []string{"depth", "12"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := EngineInfo{Move: "f1b5", Cp: 60, Pv: []string{"f1b5", "a7a6"}, Depth: 12, Nodes: 2000, Nps: 2000, Time: 1000}
+	if bm != "f1b5" || len(lines) != 1 || !reflect.DeepEqual(lines[0], want) {
+		t.Errorf("eval = %s %+v, want f1b5 %+v", bm, lines, want)
+	}
+
+	received(commands)
+	bm, lines, err = e.Eval(context.Background(), TEST_FEN, []string{"f3e5"}, []string{"depth", "10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bm != "f3e5" || len(lines) != 1 || lines[0].Cp != -80 || !reflect.DeepEqual(lines[0].Pv, []string{"f3e5", "c6e5"}) {
+		t.Errorf("searchmoves f3e5 = %s %+v, want f3e5 cp -80 pv f3e5 c6e5", bm, lines)
+	}
+	sent := received(commands)
+	if len(sent) < 3 || sent[2] != "usermove f3e5" {
+		t.Errorf("commands = %q, want the move sent with usermove after setboard", sent)
+	}
+}
+
+func TestParseFeatures(t *testing.T) {
+	body := `ping=1 myname="FakeBoard 2.0" option="Style -combo Solid /// Normal"   sigint=0 done=0`
+	want := [][2]string{{"ping", "1"}, {"myname", "FakeBoard 2.0"}, {"option", "Style -combo Solid /// Normal"}, {"sigint", "0"}, {"done", "0"}}
+	if got := parseFeatures(body); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseFeatures(%q) = %q, want %q", body, got, want)
+	}
+}
+
+func TestParseThinking(t *testing.T) {
+	pos := testPosition(t)
+	tests := []struct {
+		line string
+		pos  *chess.Position
+		want EngineInfo
+		ok   bool
+	}{
+		{
+			"12 60 100 2000 Bb5 a6",
+			pos,
+			EngineInfo{Move: "f1b5", Cp: 60, Pv: []string{"f1b5", "a7a6"}, Depth: 12, Nodes: 2000, Nps: 2000, Time: 1000},
+			true,
+		},
+		{
+			"9 100003 50 800 3. Nxe5 Nxe5 4. d4",
+			pos,
+			EngineInfo{Move: "f3e5", Mate: 3, Pv: []string{"f3e5", "c6e5", "d2d4"}, Depth: 9, Nodes: 800, Nps: 1600, Time: 500},
+			true,
+		},
+		{
+			"7 -100002 0 40 Bc4",
+			pos,
+			EngineInfo{Move: "f1c4", Mate: -2, Pv: []string{"f1c4"}, Depth: 7, Nodes: 40},
+			true,
+		},
+		{
+			"14 35 120 50000 20 41666 7\tBb5 a6",
+			pos,
+			EngineInfo{Move: "f1b5", Cp: 35, Pv: []string{"f1b5", "a7a6"}, Depth: 14, Nodes: 50000, Nps: 41666, Time: 1200, Tbhits: 7},
+			true,
+		},
+		{
+			"5 -20 10 300 e2e4 e7e5",
+			nil,
+			EngineInfo{Move: "e2e4", Cp: -20, Pv: []string{"e2e4", "e7e5"}, Depth: 5, Nodes: 300, Nps: 3000, Time: 100},
+			true,
+		},
+		{"Hint: Bb5", pos, EngineInfo{}, false},
+		{"pong 3", pos, EngineInfo{}, false},
+	}
+	for _, test := range tests {
+		got, ok := parseThinking(test.line, test.pos)
+		if ok != test.ok || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseThinking(%q) = %+v %v, want %+v %v", test.line, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestPvMoves(t *testing.T) {
+	start := chess.NewGame().Position()
+	tests := []struct {
+		pos  *chess.Position
+		pv   string
+		want []string
+	}{
+		{start, "1. e4 e5 2. Nf3 Nc6 3. Bb5", []string{"e2e4", "e7e5", "g1f3", "b8c6", "f1b5"}},
+		{start, "1.e4 e5 2.Nf3", []string{"e2e4", "e7e5", "g1f3"}},
+		{start, "e2e4 e7e5 g1f3", []string{"e2e4", "e7e5", "g1f3"}},
+		{start, "e4 e5 Qh5 Nc6 Bc4 Nf6 Qxf7#", []string{"e2e4", "e7e5", "d1h5", "b8c6", "f1c4", "g8f6", "h5f7"}},
+		{start, "e4 e5 Nf3 {book} Nc6", []string{"e2e4", "e7e5", "g1f3"}},
+		{start, "e4 e4", []string{"e2e4"}},
+		{testPosition(t), "3. Bc4 Bc5 4. 0-0 Nf6", []string{"f1c4", "f8c5", "e1g1", "g8f6"}},
+		{nil, "e2e4 e7e5", []string{"e2e4", "e7e5"}},
+	}
+	for _, test := range tests {
+		if got := pvMoves(test.pos, test.pv); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("pvMoves(%q) = %q, want %q", test.pv, got, test.want)
+		}
+	}
+}
+
+func TestCECPMove(t *testing.T) {
+	pos := testPosition(t)
+	tests := []struct {
+		move string
+		want string
+	}{
+		{"Bb5", "f1b5"},
+		{"f1b5", "f1b5"},
+		{"Nxe5", "f3e5"},
+		{"Ke2", "e1e2"},
+		{"Bb6", ""},
+		{"e1g1", ""},
+	}
+	for _, test := range tests {
+		got := ""
+		if m := cecpMove(pos, test.move); m != nil {
+			got = (chess.UCINotation{}).Encode(pos, m)
+		}
+		if got != test.want {
+			t.Errorf("cecpMove(%s) = %q, want %q", test.move, got, test.want)
+		}
+	}
+}
+
+func TestAfterMove(t *testing.T) {
+	tests := []struct {
+		name string
+		info EngineInfo
+		want EngineInfo
+	}{
+		{
+			"centipawns",
+			EngineInfo{Move: "c6e5", Cp: 80, Wdl: []int{500, 400, 100}, Pv: []string{"c6e5"}, Depth: 10},
+			EngineInfo{Move: "f3e5", Cp: -80, Pv: []string{"f3e5", "c6e5"}, Depth: 10},
+		},
+		{
+			"reply mates",
+			EngineInfo{Move: "d8h4", Mate: 2, Pv: []string{"d8h4"}},
+			EngineInfo{Move: "f3e5", Mate: -2, Pv: []string{"f3e5", "d8h4"}},
+		},
+		{
+			"reply is mated",
+			EngineInfo{Move: "e8e7", Mate: -2, Pv: []string{"e8e7"}},
+			EngineInfo{Move: "f3e5", Mate: 3, Pv: []string{"f3e5", "e8e7"}},
+		},
+		{
+			"reply is mated already",
+			EngineInfo{Mated: true},
+			EngineInfo{Move: "f3e5", Mate: 1, Pv: []string{"f3e5"}},
+		},
+	}
+	for _, test := range tests {
+		if got := afterMove("f3e5", test.info); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: afterMove = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+// testPosition returns the position of TEST_FEN.
+func testPosition(t *testing.T) *chess.Position {
+	t.Helper()
+	opt, err := chess.FEN(TEST_FEN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chess.NewGame(opt).Position()
+}
@@ -0,0 +1,654 @@
+package tactics
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// QUIT_TIMEOUT is how long Close waits for the engine to exit after "quit".
+const QUIT_TIMEOUT = 5 * time.Second
+
+// MAX_LINE is the longest line of engine output that can be read; deep
+// searches with many lines can print info lines beyond bufio's 64KB default.
+const MAX_LINE = 1024 * 1024
+
+// WARMUP_FEN and WARMUP_MOVETIME are the position and milliseconds of the
+// discarded search an engine runs after starting, so the first real search
+// does not pay for a cold hash table.
+const WARMUP_FEN = "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1"
+const WARMUP_MOVETIME = "2000"
+
+// MAX_HALFMOVE and MAX_FULLMOVE are the highest move counters passed to the
+// engine as they are: the seventy-five move rule ends a game after 150 half
+// moves without a capture or pawn move, and none lasts anywhere near
+// MAX_FULLMOVE moves. A clock of 100 to 150 is a real fifty-move position and
+// is kept, even though the engine will score it as drawn.
+const MAX_HALFMOVE = 150
+const MAX_FULLMOVE = 10000
+
+// EngineTimeout bounds how long send waits for each line of a reply (0 waits
+// forever).
+var EngineTimeout = time.Minute
+
+// MaxRestarts caps how many times the engine is restarted while analyzing a
+// single position.
+var MaxRestarts = 3
+
+// Verbose logs every command sent to and line read from the engine, at debug
+// level.
+var Verbose = false
+
+// ErrEngineDied is returned by send when the engine's output closes before it
+// finishes replying.
+var ErrEngineDied = errors.New("engine closed its output unexpectedly")
+
+// ErrNoMove is returned by send when the engine reports it has no move to
+// play, because the position is already checkmate or stalemate.
+var ErrNoMove = errors.New("engine has no legal move")
+
+// ErrNoScore is returned by Eval when the engine played a bestmove without
+// reporting a score for it, even after searching longer, as very short
+// searches sometimes do.
+var ErrNoScore = errors.New("engine reported no score")
+
+// NO_SCORE_RETRIES is how many times Eval searches again, for twice as long
+// each time, when the engine reports no score.
+const NO_SCORE_RETRIES = 1
+
+// ErrEngineTimeout is returned by send when the engine stops replying for
+// longer than EngineTimeout.
+var ErrEngineTimeout = errors.New("timed out waiting for engine")
+
+// Engine is a UCI engine subprocess, or with Protocol PROTOCOL_CECP an xboard
+// one. Each Engine is used by one goroutine at a time.
+type Engine struct {
+	// Path is the engine binary started by Start.
+	Path string
+	// Protocol is the protocol the engine speaks, PROTOCOL_UCI when empty.
+	Protocol string
+	// Args are passed to the engine binary on its command line.
+	Args []string
+	// Stderr receives the engine's standard error, os.Stderr when nil.
+	Stderr io.Writer
+	// Options holds the name/value pairs sent with setoption each time the
+	// engine is started.
+	Options [][]string
+	// Cache, if set, holds earlier Eval results to reuse.
+	Cache *EvalCache
+	// Warmup runs a WARMUP_MOVETIME search of WARMUP_FEN each time the
+	// engine is started.
+	Warmup bool
+	// OnRestart, if set, is called each time Restart runs, e.g. to count
+	// restarts.
+	OnRestart func()
+	// Name and Author are the engine's "id" replies to "uci", or its myname
+	// feature over CECP.
+	Name   string
+	Author string
+
+	cmd   *exec.Cmd
+	in    io.Writer
+	proto protocol
+	// lines delivers the engine's output one line at a time; it is closed
+	// when the output ends.
+	lines chan string
+}
+
+// NormalizeFEN returns fen with its fields separated by single spaces and
+// a halfmove clock and fullmove number the engine will parse as meant: missing,
+// malformed or absurd ones are replaced with 0 and 1. FENs with more than six
+// fields, as some variants use, only have their spacing fixed.
+func NormalizeFEN(fen string) string {
+	fields := strings.Fields(fen)
+	if len(fields) < 4 || len(fields) > 6 {
+		return strings.Join(fields, " ")
+	}
+	halfmove, fullmove := "0", "1"
+	if len(fields) > 4 {
+		if n, err := strconv.Atoi(fields[4]); err == nil && n >= 0 && n <= MAX_HALFMOVE {
+			halfmove = strconv.Itoa(n)
+		}
+	}
+	if len(fields) > 5 {
+		if n, err := strconv.Atoi(fields[5]); err == nil && n >= 1 && n <= MAX_FULLMOVE {
+			fullmove = strconv.Itoa(n)
+		}
+	}
+	return strings.Join(append(fields[:4], halfmove, fullmove), " ")
+}
+
+// EngineInfo is one ranked engine line parsed from an "info" reply: its
+// principal variation and score for the side to move.
+type EngineInfo struct {
+	Move string
+	Cp   int
+	// Mate is the signed number of moves to mate, positive when the side to
+	// move mates and negative when it is mated; zero means no mate was
+	// reported.
+	Mate int
+	// Mated is set for "mate 0": the side to move is already checkmated.
+	Mated bool
+	// Wdl holds the win, draw and loss chances in per mille reported with
+	// UCI_ShowWDL, or nil.
+	Wdl []int
+	Pv  []string
+	// Depth, Nodes, Nps and Time (in milliseconds) describe the search that
+	// produced the line, and Tbhits counts its tablebase probes that hit.
+	Depth  int
+	Nodes  int64
+	Nps    int64
+	Time   int
+	Tbhits int64
+	// Cached is set on lines Eval took from Cache rather than searching.
+	Cached bool
+}
+
+// send writes cmd to the engine and waits for its reply, if any, giving up
+// when ctx is done. For "go" the result is the best move and secondary holds
+// the last info line seen for each multipv index.
+func (e *Engine) send(ctx context.Context, cmd string, args ...string) (string, []EngineInfo, error) {
+	ok := "ok"
+	secondary := []EngineInfo{}
+	
+	switch cmd {
+	case "uci":
+		command := cmd + "\n"
+		if Verbose {
+			slog.Debug("engine command", "cmd", strings.TrimSpace(command))
+		}
+		_, err := io.WriteString(e.in, command)
+		if err != nil {
+			return "error", nil, ErrEngineDied
+		}
+		
+		// read until we see "uciok"
+		for {
+			line, err := e.readLine(ctx)
+			if err != nil {
+				return "error", nil, err
+			}
+			if Verbose {
+				slog.Debug("engine output", "line", line)
+			}
+			// banners and options are ignored, only the id lines kept
+			if name, ok := strings.CutPrefix(line, "id name "); ok {
+				e.Name = name
+			} else if author, ok := strings.CutPrefix(line, "id author "); ok {
+				e.Author = author
+			}
+			if line == "uciok" {
+				break
+			}
+		}
+		
+	case "isready":
+		command := cmd + "\n"
+		if Verbose {
+			slog.Debug("engine command", "cmd", strings.TrimSpace(command))
+		}
+		_, err := io.WriteString(e.in, command)
+		if err != nil {
+			return "error", nil, ErrEngineDied
+		}
+		
+		// read until we see "readyok"
+		for {
+			line, err := e.readLine(ctx)
+			if err != nil {
+				return "error", nil, err
+			}
+			if Verbose {
+				slog.Debug("engine output", "line", line)
+			}
+			if line == "readyok" {
+				break
+			}
+		}
+		
+	case "setoption":
+		command := "setoption name " + args[0] + " value " + args[1] + "\n"
+		if Verbose {
+			slog.Debug("engine command", "cmd", strings.TrimSpace(command))
+		}
+		_, err := io.WriteString(e.in, command)
+		if err != nil {
+			return "error", nil, ErrEngineDied
+		}
+
+	case "ucinewgame", "quit":
+		command := cmd + "\n"
+		if Verbose {
+			slog.Debug("engine command", "cmd", strings.TrimSpace(command))
+		}
+		_, err := io.WriteString(e.in, command)
+		if err != nil {
+			return "error", nil, ErrEngineDied
+		}
+
+	case "position":
+		command := "position fen " + NormalizeFEN(args[0]) + "\n"
+		if Verbose {
+			slog.Debug("engine command", "cmd", strings.TrimSpace(command))
+		}
+		_, err := io.WriteString(e.in, command)
+		if err != nil {
+			return "error", nil, ErrEngineDied
+		}
+		
+	case "go":		
+		command := "go"
+		for _, arg := range args {
+			command = command + " " + arg
+		}
+		command += "\n"
+		if Verbose {
+			slog.Debug("engine command", "cmd", strings.TrimSpace(command))
+		}
+		_, err := io.WriteString(e.in, command)
+		if err != nil {
+			return "error", nil, ErrEngineDied
+		}
+
+		// read until we see "bestmove"
+		rempv := regexp.MustCompile(" multipv ([0-9]+) ")
+		infos := []string{}
+		for {
+			line, err := e.readLine(ctx)
+			if err != nil && ctx.Err() != nil {
+				e.stopSearch()
+				return "error", nil, err
+			}
+			if err != nil {
+				return "error", nil, err
+			}
+			if Verbose {
+				slog.Debug("engine output", "line", line)
+			}
+			if strings.HasPrefix(line, "bestmove") {
+				rebm := regexp.MustCompile("bestmove ([a-z0-9]+)")
+				bmarr := rebm.FindStringSubmatch(line)
+				if len(bmarr) < 2 || bmarr[1] == "0000" {
+					// "bestmove (none)" or "bestmove 0000"
+					return "error", nil, ErrNoMove
+				}
+				ok = bmarr[1]
+				break
+			}
+			// only info lines with a score replace the line kept for their
+			// multipv index, not currmove, hashfull or string updates
+			if strings.HasPrefix(line, "info") && strings.Contains(line, " score ") &&
+				!strings.HasPrefix(line, "info string") {
+				index := 1
+				mpvarr := rempv.FindStringSubmatch(line)
+				if len(mpvarr) > 1 {
+					index, _ = strconv.Atoi(mpvarr[1])
+				}
+				if index < 1 {
+					continue
+				}
+				for len(infos) < index {
+					infos = append(infos, "")
+				}
+				infos[index-1] = line
+			}
+		}
+		for _, info := range infos {
+			secondary = append(secondary, parseInfo(info))
+		}
+		
+	default:
+		return "error", nil, errors.New("Unrecognized cmd: " + cmd)
+	}
+	
+	return ok, secondary, nil
+}
+
+// stopSearch ends a search given up on part way and waits for its bestmove,
+// so that isn't taken for the reply to the next search.
+func (e *Engine) stopSearch() {
+	if _, err := io.WriteString(e.in, "stop\n"); err != nil {
+		return
+	}
+	for {
+		line, err := e.readLine(context.Background())
+		if err != nil || strings.HasPrefix(line, "bestmove") {
+			return
+		}
+	}
+}
+
+// readLine returns the next line of engine output, waiting at most
+// EngineTimeout for it to arrive and returning ctx's error if it is done
+// first.
+func (e *Engine) readLine(ctx context.Context) (string, error) {
+	var timeout <-chan time.Time
+	if EngineTimeout > 0 {
+		timeout = time.After(EngineTimeout)
+	}
+	select {
+	case line, ok := <-e.lines:
+		if !ok {
+			return "", ErrEngineDied
+		}
+		return line, nil
+	case <-timeout:
+		return "", ErrEngineTimeout
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// Start launches Path, performs the uci handshake and applies Options. The
+// error of an engine that can't be run, or exits or stops replying before
+// it is ready, names Path.
+func (e *Engine) Start() error {
+	cmd := exec.Command(e.Path, e.Args...)
+	
+	cmd.Stderr = e.Stderr
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
+	in, err := cmd.StdinPipe()
+	if nil != err {
+		return fmt.Errorf("Error obtaining stdin: %s", err.Error())
+	}
+	engineOut, err := cmd.StdoutPipe()
+	if nil != err {
+		return fmt.Errorf("Error obtaining stdout: %s", err.Error())
+	}
+	
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("Error starting engine %s: %s", e.Path, err.Error())
+	}
+	e.cmd = cmd
+	if err := e.Attach(in, engineOut); err != nil {
+		// an engine that exits during the handshake (bad arguments, missing
+		// network file) is better described by its exit status; one that is
+		// still running but not speaking UCI is killed
+		cmd.Process.Kill()
+		if werr := cmd.Wait(); err == ErrEngineDied && werr != nil {
+			err = fmt.Errorf("%s (%s)", err.Error(), werr.Error())
+		}
+		return fmt.Errorf("Error starting engine %s: %s", e.Path, err.Error())
+	}
+	return nil
+}
+
+// Attach talks Protocol over in and out, performing the handshake and applying
+// Options. Start uses it for the engine subprocess's pipes; anything else
+// speaking the protocol, such as an in-process fake engine, can be attached
+// the same way.
+func (e *Engine) Attach(in io.Writer, engineOut io.Reader) error {
+	proto, err := newProtocol(e)
+	if err != nil {
+		return err
+	}
+	e.in, e.proto = in, proto
+	// the handshake is never given up on, EngineTimeout bounds it
+	ctx := context.Background()
+	e.lines = make(chan string, 100)
+	reader := bufio.NewScanner(engineOut)
+	reader.Buffer(make([]byte, MAX_LINE), MAX_LINE)
+	go func(reader *bufio.Scanner, lines chan<- string) {
+		for reader.Scan() {
+			lines <- reader.Text()
+		}
+		if err := reader.Err(); err != nil {
+			slog.Error("reading engine output", "err", err)
+		}
+		close(lines)
+	}(reader, e.lines)
+
+	// any banner the engine prints first is skipped by the handshake, which
+	// reads up to "uciok" or the last feature
+	if err := e.proto.handshake(ctx); err != nil {
+		return err
+	}
+	slog.Info("engine started", "name", e.Name, "author", e.Author)
+	// nothing here sends ponderhit or stop, so keep the engine from pondering
+	if err := e.proto.setOption(ctx, "Ponder", "false"); err != nil {
+		return err
+	}
+	for _, option := range e.Options {
+		if err := e.proto.setOption(ctx, option[0], option[1]); err != nil {
+			return err
+		}
+	}
+	if err := e.proto.ready(ctx); err != nil {
+		return err
+	}
+	if e.Warmup {
+		// only the search matters, not whether it was scored
+		if _, _, err := e.search(ctx, WARMUP_FEN, nil, []string{"movetime", WARMUP_MOVETIME}); err != nil && err != ErrNoScore {
+			return err
+		}
+		slog.Debug("engine warmed up", "path", e.Path)
+	}
+	return nil
+}
+
+// NewGame tells the engine the following positions are from a new game,
+// clearing its hash table.
+func (e *Engine) NewGame(ctx context.Context) error {
+	if err := e.proto.newGame(ctx); err != nil {
+		return err
+	}
+	return e.proto.ready(ctx)
+}
+
+// Restart kills the running engine and starts a fresh one.
+func (e *Engine) Restart() error {
+	e.stop()
+	slog.Warn("restarting engine", "path", e.Path)
+	if e.OnRestart != nil {
+		e.OnRestart()
+	}
+	return e.Start()
+}
+
+// stop kills the running engine.
+func (e *Engine) stop() {
+	if e.cmd == nil {
+		// attached engine, there is no process to kill
+		e.drain(QUIT_TIMEOUT)
+		return
+	}
+	e.cmd.Process.Kill()
+	e.drain(QUIT_TIMEOUT)
+	e.cmd.Wait()
+}
+
+// Close asks the engine to quit and waits for it to exit, killing it if it
+// hasn't within QUIT_TIMEOUT.
+func (e *Engine) Close() {
+	if err := e.proto.quit(); err == nil && e.drain(QUIT_TIMEOUT) {
+		if e.cmd != nil {
+			e.cmd.Wait()
+		}
+		return
+	}
+	e.stop()
+}
+
+// drain discards engine output until it ends, returning false if that takes
+// longer than timeout.
+func (e *Engine) drain(timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case _, ok := <-e.lines:
+			if !ok {
+				return true
+			}
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// discardPending throws away any engine output already waiting to be read,
+// such as the reply to a ponder search, so it isn't taken for the reply to
+// the next command.
+func (e *Engine) discardPending() {
+	for {
+		select {
+		case line, ok := <-e.lines:
+			if !ok {
+				return
+			}
+			slog.Debug("discarding stray engine output", "line", line)
+		default:
+			return
+		}
+	}
+}
+
+// Eval searches fen, restricted to moves when there are any, and returns the
+// engine's best move along with its ranked lines (one per multipv index). If
+// the engine dies during the search it is restarted and the position re-sent,
+// up to MaxRestarts times. A search that times out is treated the same way.
+// A search that ends without a score is retried for longer, NO_SCORE_RETRIES
+// times, before giving up with ErrNoScore. Results are looked up in and saved
+// to Cache when it is set, with the lines of a cache hit marked Cached.
+func (e *Engine) Eval(ctx context.Context, fen string, moves []string, limit []string) (string, []EngineInfo, error) {
+	key := fen + "|" + strings.Join(moves, " ")
+	if e.Cache != nil {
+		if bm, lines, ok := e.Cache.get(key); ok {
+			hits := make([]EngineInfo, len(lines))
+			for i, line := range lines {
+				line.Cached = true
+				hits[i] = line
+			}
+			return bm, hits, nil
+		}
+	}
+	retries := 0
+	for restarts := 0; ; restarts++ {
+		bm, lines, err := e.search(ctx, fen, moves, limit)
+		for err == ErrNoScore && retries < NO_SCORE_RETRIES {
+			retries += 1
+			limit = longer(limit)
+			slog.Info("engine reported no score, searching longer", "fen", fen, "limit", strings.Join(limit, " "))
+			bm, lines, err = e.search(ctx, fen, moves, limit)
+		}
+		if err == nil && e.Cache != nil {
+			e.Cache.put(key, bm, lines)
+		}
+		if err != ErrEngineDied && err != ErrEngineTimeout {
+			return bm, lines, err
+		}
+		if restarts >= MaxRestarts {
+			return "", nil, fmt.Errorf("engine failed %d times analyzing %s", restarts+1, fen)
+		}
+		slog.Warn("engine failed", "fen", fen, "err", err)
+		if err := e.Restart(); err != nil {
+			return "", nil, err
+		}
+	}
+}
+
+func (e *Engine) search(ctx context.Context, fen string, moves []string, limit []string) (string, []EngineInfo, error) {
+	e.discardPending()
+	bm, lines, err := e.proto.search(ctx, fen, moves, limit)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(lines) == 0 {
+		// a bestmove without a score, not a level 0.00
+		return bm, nil, ErrNoScore
+	}
+
+	return bm, lines, nil
+}
+
+// longer returns the search limit doubled where it is a time or a node
+// count, so a search that was too short to report a score can be run again.
+func longer(limit []string) []string {
+	doubled := append([]string{}, limit...)
+	for i := 0; i+1 < len(doubled); i++ {
+		if doubled[i] != "movetime" && doubled[i] != "nodes" {
+			continue
+		}
+		if n, err := strconv.Atoi(doubled[i+1]); err == nil {
+			doubled[i+1] = strconv.Itoa(n * 2)
+		}
+	}
+	return doubled
+}
+
+// ScoreMoves searches fen once for each of moves, returning their lines in
+// the same order, so candidate moves can be compared with each other and with
+// the engine's own choice.
+func (e *Engine) ScoreMoves(ctx context.Context, fen string, moves []string, limit []string) ([]EngineInfo, error) {
+	scores := []EngineInfo{}
+	for _, move := range moves {
+		_, lines, err := e.Eval(ctx, fen, []string{move}, limit)
+		if err != nil {
+			return nil, err
+		}
+		scores = append(scores, lines[0])
+	}
+	return scores, nil
+}
+
+// parseInfo reads the score, search statistics and principal variation from
+// a UCI "info" line. Fields missing from the line are left zero.
+func parseInfo(info string) EngineInfo {
+	recp := regexp.MustCompile(" cp (-?[0-9]+) ")
+	redm := regexp.MustCompile(" mate (-?[0-9]+) ")
+	redepth := regexp.MustCompile(" depth ([0-9]+)")
+	renodes := regexp.MustCompile(" nodes ([0-9]+)")
+	renps := regexp.MustCompile(" nps ([0-9]+)")
+	retime := regexp.MustCompile(" time ([0-9]+)")
+	retbhits := regexp.MustCompile(" tbhits ([0-9]+)")
+	rewdl := regexp.MustCompile(" wdl ([0-9]+) ([0-9]+) ([0-9]+)")
+	// "info depth 0 score mate 0" ends with its score
+	info += " "
+
+	line := EngineInfo{}
+	if arr := recp.FindStringSubmatch(info); len(arr) > 1 {
+		line.Cp, _ = strconv.Atoi(arr[1])
+	}
+	if arr := redm.FindStringSubmatch(info); len(arr) > 1 {
+		line.Mate, _ = strconv.Atoi(arr[1])
+		line.Mated = line.Mate == 0
+	}
+	if arr := redepth.FindStringSubmatch(info); len(arr) > 1 {
+		line.Depth, _ = strconv.Atoi(arr[1])
+	}
+	if arr := renodes.FindStringSubmatch(info); len(arr) > 1 {
+		line.Nodes, _ = strconv.ParseInt(arr[1], 10, 64)
+	}
+	if arr := renps.FindStringSubmatch(info); len(arr) > 1 {
+		line.Nps, _ = strconv.ParseInt(arr[1], 10, 64)
+	}
+	if arr := retime.FindStringSubmatch(info); len(arr) > 1 {
+		line.Time, _ = strconv.Atoi(arr[1])
+	}
+	if arr := retbhits.FindStringSubmatch(info); len(arr) > 1 {
+		line.Tbhits, _ = strconv.ParseInt(arr[1], 10, 64)
+	}
+	if arr := rewdl.FindStringSubmatch(info); len(arr) > 3 {
+		line.Wdl = make([]int, 3)
+		for i := range line.Wdl {
+			line.Wdl[i], _ = strconv.Atoi(arr[i+1])
+		}
+	}
+	if pvidx := strings.Index(info, " pv "); pvidx >= 0 {
+		line.Pv = strings.Fields(info[pvidx+len(" pv "):])
+		if len(line.Pv) > 0 {
+			line.Move = line.Pv[0]
+		}
+	}
+	return line
+}
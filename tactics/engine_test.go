@@ -0,0 +1,234 @@
+package tactics
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const TEST_FEN = "r1bqkbnr/pppp1ppp/2n5/4p3/4P3/5N2/PPPP1PPP/RNBQKB1R w KQkq - 2 3"
+
+// fakeEngine attaches an Engine to an in-process UCI engine over io.Pipe. It
+// answers the first go with the lines of searches[0], the next with
+// searches[1], and so on.
+func fakeEngine(t *testing.T, searches ...[]string) *Engine {
+	t.Helper()
+	inr, inw := io.Pipe()
+	outr, outw := io.Pipe()
+	go func() {
+		defer outw.Close()
+		commands := bufio.NewScanner(inr)
+		reply := func(lines ...string) {
+			for _, line := range lines {
+				io.WriteString(outw, line+"\n")
+			}
+		}
+		reply("FakeFish by test")
+		for commands.Scan() {
+			command := commands.Text()
+			switch {
+			case command == "uci":
+				reply("id name FakeFish", "id author test", "uciok")
+			case command == "isready":
+				reply("readyok")
+			case strings.HasPrefix(command, "go"):
+				if len(searches) == 0 {
+					t.Errorf("unexpected search %q", command)
+					reply("bestmove (none)")
+					continue
+				}
+				reply(searches[0]...)
+				searches = searches[1:]
+			case command == "quit":
+				return
+			}
+		}
+	}()
+	e := &Engine{}
+	if err := e.Attach(inw, outr); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		e.Close()
+		inw.Close()
+	})
+	return e
+}
+
+func TestParseInfo(t *testing.T) {
+	tests := []struct {
+		info string
+		want EngineInfo
+	}{
+		{
+			"info depth 20 seldepth 28 multipv 1 score cp 35 wdl 120 800 80 nodes 123456 nps 1000000 tbhits 2 time 123 pv e2e4 e7e5 g1f3",
+			EngineInfo{Move: "e2e4", Cp: 35, Wdl: []int{120, 800, 80}, Pv: []string{"e2e4", "e7e5", "g1f3"}, Depth: 20, Nodes: 123456, Nps: 1000000, Time: 123, Tbhits: 2},
+		},
+		{
+			"info depth 18 score cp -240 nodes 1000 time 10 pv d8h4",
+			EngineInfo{Move: "d8h4", Cp: -240, Pv: []string{"d8h4"}, Depth: 18, Nodes: 1000, Time: 10},
+		},
+		{
+			"info depth 22 score mate 3 nodes 5000 pv f7f8q e8f8 d1d8",
+			EngineInfo{Move: "f7f8q", Mate: 3, Pv: []string{"f7f8q", "e8f8", "d1d8"}, Depth: 22, Nodes: 5000},
+		},
+		{
+			"info depth 22 score mate -2 pv g1h1",
+			EngineInfo{Move: "g1h1", Mate: -2, Pv: []string{"g1h1"}, Depth: 22},
+		},
+		{
+			"info depth 0 score mate 0",
+			EngineInfo{Mated: true},
+		},
+	}
+	for _, test := range tests {
+		if got := parseInfo(test.info); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseInfo(%q) = %+v, want %+v", test.info, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeFEN(t *testing.T) {
+	const board = "r1bqkbnr/pppp1ppp/2n5/4p3/4P3/5N2/PPPP1PPP/RNBQKB1R w KQkq -"
+	tests := []struct {
+		name string
+		fen  string
+		want string
+	}{
+		{"well formed", TEST_FEN, TEST_FEN},
+		{"extra spaces", "  " + strings.ReplaceAll(TEST_FEN, " ", "   ") + "\t", TEST_FEN},
+		{"missing counters", board, board + " 0 1"},
+		{"missing fullmove number", board + " 7", board + " 7 1"},
+		{"malformed halfmove clock", board + " x 3", board + " 0 3"},
+		{"negative halfmove clock", board + " -2 3", board + " 0 3"},
+		{"fullmove number of 0", board + " 2 0", board + " 2 1"},
+		{"leading zeros", board + " 07 003", board + " 7 3"},
+		{"fifty-move clock kept", board + " 120 60", board + " 120 60"},
+		{"halfmove clock too large", board + " 151 60", board + " 0 60"},
+		{"fullmove number too large", board + " 2 10001", board + " 2 1"},
+		{"7 fields", strings.ReplaceAll(board, " ", "  ") + " 3+3 0 1", board + " 3+3 0 1"},
+		{"too few fields", "8/8/8/8  w", "8/8/8/8 w"},
+	}
+	for _, test := range tests {
+		if got := NormalizeFEN(test.fen); got != test.want {
+			t.Errorf("%s: NormalizeFEN(%q) = %q, want %q", test.name, test.fen, got, test.want)
+		}
+	}
+}
+
+func TestEval(t *testing.T) {
+	e := fakeEngine(t, []string{
+		"info depth 1 score cp 10 pv d2d4",
+		"info string NNUE evaluation enabled",
+		"info depth 12 multipv 1 score cp 60 nodes 2000 pv f1b5 a7a6",
+		"info depth 12 multipv 2 score mate -4 nodes 2000 pv d2d4 e5d4",
+		"info depth 12 currmove f1c4 currmovenumber 3",
+		"bestmove f1b5 ponder a7a6",
+	}, []string{
+		"info depth 10 score mate 2 pv f3e5",
+		"bestmove f3e5",
+	})
+
+	bm, lines, err := e.Eval(context.Background(), TEST_FEN, nil, []string{"depth", "12"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bm != "f1b5" {
+		t.Errorf("bestmove = %s, want f1b5", bm)
+	}
+	if len(lines) != 2 || lines[0].Cp != 60 || lines[0].Move != "f1b5" || lines[1].Mate != -4 || lines[1].Move != "d2d4" {
+		t.Errorf("lines = %+v, want cp 60 f1b5 and mate -4 d2d4", lines)
+	}
+
+	bm, lines, err = e.Eval(context.Background(), TEST_FEN, []string{"f3e5"}, []string{"depth", "10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bm != "f3e5" || len(lines) != 1 || lines[0].Mate != 2 {
+		t.Errorf("searchmoves f3e5 = %s %+v, want f3e5 mate 2", bm, lines)
+	}
+}
+
+func TestEvalNoMove(t *testing.T) {
+	for _, bestmove := range []string{"bestmove (none)", "bestmove 0000"} {
+		e := fakeEngine(t, []string{"info depth 0 score mate 0", bestmove})
+		_, _, err := e.Eval(context.Background(), TEST_FEN, nil, []string{"depth", "1"})
+		if err != ErrNoMove {
+			t.Errorf("%s: err = %v, want ErrNoMove", bestmove, err)
+		}
+	}
+}
+
+func TestDetectBlunder(t *testing.T) {
+	std := Thresholds{MinCentipawns: 100, DrawBand: 20, MaxMateIn: 5}
+	wdl := Thresholds{MinCentipawns: 100, MaxMateIn: 5, UseWDL: true, MinWinDrop: 30}
+	tests := []struct {
+		name   string
+		prev   EngineInfo
+		played EngineInfo
+		t      Thresholds
+		want   int
+	}{
+		{"walks into mate", EngineInfo{Cp: 50}, EngineInfo{Mate: -3}, std, MATE_BLUNDER},
+		{"mate too long to count", EngineInfo{Cp: 50}, EngineInfo{Mate: -8, Cp: -900}, std, 0},
+		{"win chances drop", EngineInfo{Cp: 80, Wdl: []int{600, 350, 50}}, EngineInfo{Cp: 10, Wdl: []int{100, 500, 400}}, wdl, 70},
+		{"win chances hold", EngineInfo{Cp: 300, Wdl: []int{900, 100, 0}}, EngineInfo{Cp: -50, Wdl: []int{850, 150, 0}}, wdl, 0},
+		{"centipawns lost", EngineInfo{Cp: 40}, EngineInfo{Cp: -250}, std, 290},
+		{"drop too small", EngineInfo{Cp: 40}, EngineInfo{Cp: -30}, std, 0},
+		{"still ahead", EngineInfo{Cp: 400}, EngineInfo{Cp: 250}, std, 0},
+		{"win thrown to a draw", EngineInfo{Cp: 350}, EngineInfo{Cp: 5}, std, 345},
+		{"draw band disabled", EngineInfo{Cp: 350}, EngineInfo{Cp: 5}, Thresholds{MinCentipawns: 100, MaxMateIn: 5}, 0},
+	}
+	for _, test := range tests {
+		if got := DetectBlunder(test.prev, test.played, test.t); got != test.want {
+			t.Errorf("%s: DetectBlunder = %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	std := Thresholds{MinCentipawns: 100, DrawBand: 20, MaxMateIn: 5, Prefer: PREFER_MATE}
+	cp := Thresholds{MinCentipawns: 100, DrawBand: 20, MaxMateIn: 5, Prefer: PREFER_CP}
+	tests := []struct {
+		name                   string
+		smcp, smdm, bmcp, bmdm int
+		t                      Thresholds
+		want                   Kind
+	}{
+		{"mate allowed", 0, -3, 50, 0, std, MATE_ALLOWED},
+		{"mate too long to count", 0, -8, 50, 0, std, POSITIONAL_BLUNDER},
+		{"mate missed", 200, 0, 0, 2, std, MATE_MISSED},
+		{"mate missed, losing a rook", -400, 0, 0, 3, std, MATE_MISSED},
+		{"material first with PREFER_CP", -400, 0, 0, 3, cp, MATERIAL_BLUNDER},
+		{"mate allowed counts as material with PREFER_CP", 0, -3, 250, 0, cp, MATERIAL_BLUNDER},
+		{"still mating, only slower, with PREFER_CP", 0, 7, 0, 2, cp, POSITIONAL_BLUNDER},
+		{"positional blunder with PREFER_CP", -50, 0, 120, 0, cp, POSITIONAL_BLUNDER},
+		{"still mating, only slower", 0, 7, 0, 2, std, POSITIONAL_BLUNDER},
+		{"draw blunder", 5, 0, 450, 0, std, DRAW_BLUNDER},
+		{"level but no win thrown away", 5, 0, 120, 0, std, POSITIONAL_BLUNDER},
+		{"material blunder", -200, 0, 150, 0, std, MATERIAL_BLUNDER},
+		{"positional blunder", -50, 0, 120, 0, std, POSITIONAL_BLUNDER},
+	}
+	for _, test := range tests {
+		if got := Classify(test.smcp, test.smdm, test.bmcp, test.bmdm, test.t); got != test.want {
+			t.Errorf("%s: Classify = %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestEvalCache(t *testing.T) {
+	e := fakeEngine(t, []string{"info depth 8 score cp 25 time 40 pv f1b5", "bestmove f1b5"})
+	e.Cache = NewEvalCache(0)
+	for i, cached := range []bool{false, true} {
+		bm, lines, err := e.Eval(context.Background(), TEST_FEN, nil, []string{"depth", "8"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bm != "f1b5" || lines[0].Cp != 25 || lines[0].Cached != cached {
+			t.Errorf("search %d = %s %+v, want f1b5 cp 25 cached %v", i+1, bm, lines[0], cached)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package tactics
+
+import (
+	"context"
+	"errors"
+)
+
+// PROTOCOL_UCI and PROTOCOL_CECP are the Engine.Protocol choices: UCI, or
+// CECP, the xboard/WinBoard protocol.
+const PROTOCOL_UCI = "uci"
+const PROTOCOL_CECP = "cecp"
+
+// protocol is how an Engine talks to its engine, turning the operations Attach,
+// NewGame, Eval and Close need into the commands the engine understands.
+type protocol interface {
+	// handshake introduces the engine, reading its name and what it supports.
+	handshake(ctx context.Context) error
+	setOption(ctx context.Context, name string, value string) error
+	// ready waits for the engine to finish with the commands sent so far.
+	ready(ctx context.Context) error
+	newGame(ctx context.Context) error
+	// search returns the engine's best move in fen, restricted to moves when
+	// there are any, and its lines for it, searching as long as limit says.
+	search(ctx context.Context, fen string, moves []string, limit []string) (string, []EngineInfo, error)
+	quit() error
+}
+
+// newProtocol returns the implementation of e.Protocol, UCI when it is empty.
+func newProtocol(e *Engine) (protocol, error) {
+	switch e.Protocol {
+	case "", PROTOCOL_UCI:
+		return uci{e}, nil
+	case PROTOCOL_CECP:
+		return &cecp{e: e}, nil
+	}
+	return nil, errors.New("Unrecognized protocol: " + e.Protocol)
+}
+
+// uci speaks UCI through Engine.send.
+type uci struct {
+	e *Engine
+}
+
+func (p uci) handshake(ctx context.Context) error {
+	_, _, err := p.e.send(ctx, "uci")
+	return err
+}
+
+func (p uci) setOption(ctx context.Context, name string, value string) error {
+	_, _, err := p.e.send(ctx, "setoption", name, value)
+	return err
+}
+
+func (p uci) ready(ctx context.Context) error {
+	_, _, err := p.e.send(ctx, "isready")
+	return err
+}
+
+func (p uci) newGame(ctx context.Context) error {
+	_, _, err := p.e.send(ctx, "ucinewgame")
+	return err
+}
+
+func (p uci) search(ctx context.Context, fen string, moves []string, limit []string) (string, []EngineInfo, error) {
+	_, _, err := p.e.send(ctx, "position", fen)
+	if err != nil {
+		return "", nil, err
+	}
+	// make sure the engine has taken the position before searching it
+	if err := p.ready(ctx); err != nil {
+		return "", nil, err
+	}
+	if len(moves) == 0 {
+		// find best move
+		return p.e.send(ctx, "go", limit...)
+	}
+	// find cp, dm for the best of moves
+	args := append(append([]string{}, limit...), "searchmoves")
+	return p.e.send(ctx, "go", append(args, moves...)...)
+}
+
+func (p uci) quit() error {
+	_, _, err := p.e.send(context.Background(), "quit")
+	return err
+}
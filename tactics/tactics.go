@@ -0,0 +1,144 @@
+// Package tactics runs UCI and CECP (xboard) chess engines and judges the
+// moves they score, the engine and blunder detection half of
+// chess_tactics_discovery. An Engine searches positions with Eval, and
+// DetectBlunder and Classify decide whether a played move threw the game away
+// and how.
+package tactics
+
+const (
+	// MATE_BLUNDER is the blunder recorded for a move that walks into mate.
+	MATE_BLUNDER = 10000
+	// MISSED_MATE_BLUNDER is the blunder recorded for a move that passes up
+	// a forced mate.
+	MISSED_MATE_BLUNDER = 20000
+	// MATERIAL_CENTIPAWNS is the gap between the best and played moves above
+	// which a blunder is classified as losing material.
+	MATERIAL_CENTIPAWNS = 300
+	// MATE_WORTH is what Worth counts a mate as, in centipawns: a mate in N
+	// is worth MATE_WORTH - N and being mated in N -MATE_WORTH + N.
+	MATE_WORTH = 100000
+)
+
+// Kind classifies a discovered tactic.
+type Kind string
+
+const (
+	MATE_ALLOWED       Kind = "mate_allowed"
+	MATE_MISSED        Kind = "mate_missed"
+	DRAW_BLUNDER       Kind = "draw_blunder"
+	MATERIAL_BLUNDER   Kind = "material_blunder"
+	POSITIONAL_BLUNDER Kind = "positional_blunder"
+)
+
+// KINDS lists every Kind.
+var KINDS = []Kind{MATE_ALLOWED, MATE_MISSED, DRAW_BLUNDER, MATERIAL_BLUNDER, POSITIONAL_BLUNDER}
+
+// PREFER_MATE and PREFER_CP are the Thresholds.Prefer choices.
+const PREFER_MATE = "mate"
+const PREFER_CP = "cp"
+
+// Thresholds decide which drops in evaluation DetectBlunder counts and how
+// Classify labels them.
+type Thresholds struct {
+	// MinCentipawns is the drop in evaluation that marks a move as a blunder.
+	MinCentipawns int
+	// DrawBand is how close to 0 centipawns a score after a winning one must
+	// fall to count as throwing away the win; 0 disables the check.
+	DrawBand int
+	// MaxMateIn is the longest mate against the mover that counts as a blunder.
+	MaxMateIn int
+	// UseWDL detects blunders by MinWinDrop, the fall in the mover's winning
+	// chances in percentage points, when the engine reports them, instead of
+	// by MinCentipawns.
+	UseWDL     bool
+	MinWinDrop int
+	// Prefer is which signal Classify looks at first, PREFER_MATE or
+	// PREFER_CP: with PREFER_CP a blunder that also loses material is a
+	// MATERIAL_BLUNDER even when it allows or misses a mate, the mate
+	// counting for its Worth in centipawns.
+	Prefer string
+}
+
+// DetectBlunder compares played, the engine's score after a move, with prev,
+// its score after the same side's previous move, both from the mover's side,
+// and returns how much the move threw away: MATE_BLUNDER for walking into a
+// mate within t.MaxMateIn, the centipawns lost for a drop t counts, or 0 when
+// the move is no blunder.
+func DetectBlunder(prev EngineInfo, played EngineInfo, t Thresholds) int {
+	switch {
+	case played.Mate < 0:
+		// a longer mate than t.MaxMateIn is not counted, nor checked for
+		// centipawns
+		if MatedIn(played.Mate, t.MaxMateIn) {
+			return MATE_BLUNDER
+		}
+	case t.UseWDL && prev.Wdl != nil && played.Wdl != nil:
+		// judge by the drop in winning chances instead of centipawns
+		if WinChance(prev.Wdl) - WinChance(played.Wdl) >= t.MinWinDrop * 10 && played.Cp < prev.Cp {
+			return prev.Cp - played.Cp
+		}
+	case played.Cp < 0 && played.Cp < prev.Cp && prev.Cp - played.Cp >= t.MinCentipawns:
+		return prev.Cp - played.Cp
+	case prev.Cp >= t.MinCentipawns && Drawn(played.Cp, played.Mate, t.DrawBand):
+		// a winning position thrown away to a draw
+		return prev.Cp - played.Cp
+	}
+	return 0
+}
+
+// MatedIn reports whether dm, a mate score from the mover's side, has the
+// mover mated within maxMateIn moves.
+func MatedIn(dm int, maxMateIn int) bool {
+	return dm < 0 && -dm <= maxMateIn
+}
+
+// MatesIn reports whether dm, a mate score from the mover's side, has the
+// mover mating within maxMateIn moves.
+func MatesIn(dm int, maxMateIn int) bool {
+	return dm > 0 && dm <= maxMateIn
+}
+
+// Drawn reports whether cp, dm is a dead level score, within drawBand
+// centipawns of zero. A drawBand of 0 never counts a score as drawn.
+func Drawn(cp int, dm int, drawBand int) bool {
+	return drawBand > 0 && dm == 0 && cp <= drawBand && cp >= -drawBand
+}
+
+// Classify picks the Kind of a blunder from the played move's (sm) and best
+// move's (bm) scores, all from the mover's side, under t's MaxMateIn,
+// DrawBand and Prefer.
+func Classify(smcp int, smdm int, bmcp int, bmdm int, t Thresholds) Kind {
+	maxMateIn, drawBand := t.MaxMateIn, t.DrawBand
+	switch {
+	case t.Prefer == PREFER_CP && Worth(EngineInfo{Cp: bmcp, Mate: bmdm}) - Worth(EngineInfo{Cp: smcp, Mate: smdm}) >= MATERIAL_CENTIPAWNS:
+		return MATERIAL_BLUNDER
+	case MatedIn(smdm, maxMateIn):
+		return MATE_ALLOWED
+	case MatesIn(bmdm, maxMateIn) && smdm <= 0:
+		return MATE_MISSED
+	case Drawn(smcp, smdm, drawBand) && (bmdm > 0 || bmcp >= MATERIAL_CENTIPAWNS):
+		return DRAW_BLUNDER
+	case bmcp - smcp >= MATERIAL_CENTIPAWNS:
+		return MATERIAL_BLUNDER
+	default:
+		return POSITIONAL_BLUNDER
+	}
+}
+
+// WinChance returns the expected score, in per mille, of the win, draw and
+// loss chances wdl: a draw counts for half a win.
+func WinChance(wdl []int) int {
+	return wdl[0] + wdl[1]/2
+}
+
+// Worth orders scores from the mover's side: any mate for the mover above any
+// centipawns, and a sooner mate above a longer one.
+func Worth(info EngineInfo) int {
+	switch {
+	case info.Mate > 0:
+		return MATE_WORTH - info.Mate
+	case info.Mate < 0:
+		return -MATE_WORTH - info.Mate
+	}
+	return info.Cp
+}